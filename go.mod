@@ -3,17 +3,23 @@ module bitbucket.org/qubole/wireguard
 go 1.13
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/alicebob/miniredis v2.5.0+incompatible
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/fatih/gomodifytags v1.6.0 // indirect
 	github.com/go-kit/kit v0.10.0
+	github.com/go-redis/redis v6.15.9+incompatible
 	github.com/golang/protobuf v1.3.2
+	github.com/gomodule/redigo v1.7.0 // indirect
 	github.com/gorilla/mux v1.7.4
 	github.com/heptio/workgroup v0.8.0-beta.1
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/pkg/errors v0.8.1
 	github.com/spf13/cast v1.3.1
+	github.com/yuin/gopher-lua v0.0.0-20191220021717-ab39c6098bdb // indirect
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/zap v1.15.0
-	golang.org/x/crypto v0.0.0-20200602180216-279210d13fed // indirect
+	golang.org/x/crypto v0.0.0-20200602180216-279210d13fed
 	golang.org/x/sys v0.0.0-20200602225109-6fdc65e7d980 // indirect
 	golang.zx2c4.com/wireguard v0.0.20200320
 	inet.af/netaddr v0.0.0-20200609101420-b996229ef6ee
@@ -56,7 +56,7 @@ func FormatPath(routerName, path string) string {
 	}
 
 	if fc == nil {
-		return ""
+		return path
 	}
 
 	matches := pathParamsRegexp.FindAllString(path, -1)
@@ -68,6 +68,15 @@ func FormatPath(routerName, path string) string {
 	return path
 }
 
+// Param returns value of path parameter name, e.g. id of "/wgclient/:id".
+// It works for gorilla and httprouter routers.
+func Param(r *http.Request, name string) string {
+	if v, ok := gmux.Vars(r)[name]; ok {
+		return v
+	}
+	return httprouter.ParamsFromContext(r.Context()).ByName(name)
+}
+
 // Group is router under a prefix
 type Group struct {
 	router Router
@@ -0,0 +1,195 @@
+// Package scheduler runs periodic jobs as workgroup functions.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/internal/logger"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	// ErrJobNotFound means no job is registered with the name.
+	ErrJobNotFound = errors.New("job not found")
+
+	// ErrJobRunning means previous run of job has not finished yet.
+	ErrJobRunning = errors.New("job is already running")
+
+	// ErrIntervalInvalid means job interval is not positive, it would run in a tight loop.
+	ErrIntervalInvalid = errors.New("job interval must be positive")
+)
+
+// RunFn type to encapsulate a goroutine.
+type RunFn func(<-chan struct{}) error
+
+// JobFn is the work done by a job.
+type JobFn func(context.Context) error
+
+// Job is a periodic function.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Jitter   time.Duration // random delay up to jitter is added to every interval
+	Fn       JobFn
+}
+
+// Status of a job.
+type Status struct {
+	Name         string        `json:"name"`
+	Interval     time.Duration `json:"interval"`
+	Running      bool          `json:"running"`
+	Runs         int           `json:"runs"`
+	Skipped      int           `json:"skipped"`
+	LastRun      time.Time     `json:"last_run,omitempty"`
+	LastDuration time.Duration `json:"last_duration"`
+	LastError    string        `json:"last_error,omitempty"`
+}
+
+type job struct {
+	sync.Mutex
+	Job
+	status Status
+}
+
+// Scheduler runs jobs.
+type Scheduler struct {
+	sync.RWMutex
+	jobs   []*job
+	logger log.Logger
+}
+
+// New is constructor.
+func New(l log.Logger) *Scheduler {
+	if l == nil {
+		l = logger.Nil()
+	}
+	return &Scheduler{logger: l}
+}
+
+// Add adds a job. Add must be called before Runnables.
+// Returns ErrIntervalInvalid if interval is not positive.
+func (s *Scheduler) Add(j Job) error {
+	if j.Interval <= 0 {
+		return ErrIntervalInvalid
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.jobs = append(s.jobs, &job{Job: j, status: Status{Name: j.Name, Interval: j.Interval}})
+	return nil
+}
+
+// Runnables returns one goroutine per job which runs it every interval till stop is closed.
+func (s *Scheduler) Runnables() []RunFn {
+	s.RLock()
+	defer s.RUnlock()
+
+	fs := []RunFn{}
+	for _, j := range s.jobs {
+		fs = append(fs, s.loop(j))
+	}
+	return fs
+}
+
+// Trigger runs a job now, unless it is already running.
+func (s *Scheduler) Trigger(ctx context.Context, name string) error {
+	j := s.job(name)
+	if j == nil {
+		return ErrJobNotFound
+	}
+	return s.run(ctx, j)
+}
+
+// Status returns status of all jobs.
+func (s *Scheduler) Status() []Status {
+	s.RLock()
+	defer s.RUnlock()
+
+	st := make([]Status, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		j.Lock()
+		st = append(st, j.status)
+		j.Unlock()
+	}
+	return st
+}
+
+func (s *Scheduler) loop(j *job) RunFn {
+	return func(stop <-chan struct{}) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go func() {
+			<-stop
+			cancel()
+		}()
+
+		for {
+			t := time.NewTimer(next(j.Interval, j.Jitter))
+			select {
+			case <-stop:
+				t.Stop()
+				return nil
+			case <-t.C:
+			}
+
+			err := s.run(ctx, j)
+			if err != nil && err != ErrJobRunning {
+				s.logger.Log("job", j.Name, "error", err)
+			}
+		}
+	}
+}
+
+// run runs job once, recording its status.
+func (s *Scheduler) run(ctx context.Context, j *job) error {
+	j.Lock()
+	if j.status.Running {
+		j.status.Skipped++
+		j.Unlock()
+		return ErrJobRunning
+	}
+	j.status.Running = true
+	j.Unlock()
+
+	begin := time.Now()
+	err := j.Fn(ctx)
+
+	j.Lock()
+	defer j.Unlock()
+
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastRun = begin
+	j.status.LastDuration = time.Since(begin)
+	j.status.LastError = ""
+	if err != nil {
+		j.status.LastError = err.Error()
+	}
+
+	return err
+}
+
+func (s *Scheduler) job(name string) *job {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, j := range s.jobs {
+		if j.Name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+func next(interval, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(int64(jitter)))
+}
@@ -0,0 +1,126 @@
+package scheduler_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/internal/scheduler"
+	"bitbucket.org/qubole/wireguard/internal/workgroup"
+)
+
+func TestSchedulerRunsJobsTillStop(t *testing.T) {
+	var runs int32
+
+	s := scheduler.New(nil)
+	s.Add(scheduler.Job{
+		Name:     "count",
+		Interval: 5 * time.Millisecond,
+		Jitter:   time.Millisecond,
+		Fn: func(ctx context.Context) error {
+			atomic.AddInt32(&runs, 1)
+			return nil
+		},
+	})
+	s.Add(scheduler.Job{
+		Name:     "fail",
+		Interval: 5 * time.Millisecond,
+		Fn: func(ctx context.Context) error {
+			return errors.New("boom")
+		},
+	})
+
+	var g workgroup.Group
+	for _, fn := range s.Runnables() {
+		g.Add(fn)
+	}
+	g.Add(func(stop <-chan struct{}) error {
+		time.Sleep(50 * time.Millisecond)
+		return errors.New("done")
+	})
+
+	result := make(chan error)
+	go func() {
+		result <- g.Run()
+	}()
+
+	select {
+	case err := <-result:
+		if err == nil || err.Error() != "done" {
+			t.Fatalf("Group.Run() = %v, want done", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("scheduler did not stop")
+	}
+
+	if atomic.LoadInt32(&runs) < 2 {
+		t.Errorf("job ran %d times, want at least 2", runs)
+	}
+
+	for _, st := range s.Status() {
+		if st.Runs < 2 || st.LastRun.IsZero() {
+			t.Errorf("Status() = %+v, want recorded runs", st)
+		}
+		if st.Name == "fail" && st.LastError != "boom" {
+			t.Errorf("Status() = %+v, want last error boom", st)
+		}
+		if st.Name == "count" && st.LastError != "" {
+			t.Errorf("Status() = %+v, want no error", st)
+		}
+	}
+}
+
+func TestSchedulerTriggerPreventsOverlap(t *testing.T) {
+	ctx := context.Background()
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	s := scheduler.New(nil)
+	s.Add(scheduler.Job{
+		Name:     "slow",
+		Interval: time.Hour,
+		Fn: func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		},
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- s.Trigger(ctx, "slow")
+	}()
+	<-started
+
+	if err := s.Trigger(ctx, "slow"); err != scheduler.ErrJobRunning {
+		t.Errorf("Trigger() while running = %v, want %v", err, scheduler.ErrJobRunning)
+	}
+	if err := s.Trigger(ctx, "missing"); err != scheduler.ErrJobNotFound {
+		t.Errorf("Trigger() unknown job = %v, want %v", err, scheduler.ErrJobNotFound)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Trigger() = %v, want nil", err)
+	}
+
+	st := s.Status()[0]
+	if st.Runs != 1 || st.Skipped != 1 || st.Running {
+		t.Errorf("Status() = %+v, want 1 run and 1 skipped", st)
+	}
+}
+
+func TestSchedulerAddRejectsInterval(t *testing.T) {
+	s := scheduler.New(nil)
+	for _, d := range []time.Duration{0, -time.Second} {
+		err := s.Add(scheduler.Job{Name: "spin", Interval: d, Fn: func(ctx context.Context) error { return nil }})
+		if err != scheduler.ErrIntervalInvalid {
+			t.Errorf("Scheduler.Add() interval %s error = %v, want %v", d, err, scheduler.ErrIntervalInvalid)
+		}
+	}
+	if st := s.Status(); len(st) != 0 {
+		t.Errorf("Scheduler.Status() = %v, want no jobs", st)
+	}
+}
@@ -2,7 +2,10 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"time"
 
@@ -27,6 +30,11 @@ type server struct {
 	notFoundHandler http.Handler
 	drainTime       int
 	routes          []Route
+
+	// tls, served over plain http when certFile is empty.
+	certFile     string
+	keyFile      string
+	clientCAFile string
 }
 
 // Option to set params.
@@ -63,7 +71,16 @@ func (s *server) Runnables() []RunFn {
 
 	fs := []RunFn{}
 	fs = append(fs, func(stop <-chan struct{}) error {
-		return h.ListenAndServe()
+		if s.certFile == "" {
+			return h.ListenAndServe()
+		}
+
+		cfg, err := s.tlsConfig()
+		if err != nil {
+			return err
+		}
+		h.TLSConfig = cfg
+		return h.ListenAndServeTLS(s.certFile, s.keyFile)
 	})
 
 	// shutdown http
@@ -88,6 +105,22 @@ func Router(r router.Router) Option {
 	}
 }
 
+// TLS serves https with certificate and key of pem files.
+func TLS(certFile, keyFile string) Option {
+	return func(s *server) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+	}
+}
+
+// ClientCA verifies client certificates with CAs of pem file when given, TLS must be set.
+// Requests without one are still served, auth middlewares decide if they are allowed.
+func ClientCA(caFile string) Option {
+	return func(s *server) {
+		s.clientCAFile = caFile
+	}
+}
+
 // DrainTime sets drainTime.
 func DrainTime(seconds int) Option {
 	return func(s *server) {
@@ -137,6 +170,26 @@ func (s *server) shutdownServer(server *http.Server, stop <-chan struct{}) error
 	return err
 }
 
+func (s *server) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.clientCAFile == "" {
+		return cfg, nil
+	}
+
+	b, err := ioutil.ReadFile(s.clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls:client ca:%v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("tls:client ca:no certificate in %s", s.clientCAFile)
+	}
+
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return cfg, nil
+}
+
 func (s *server) handle(method, path string, handler http.Handler) {
 	s.router.Handle(method, path, s.wrapHandlers(handler))
 }
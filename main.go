@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
+	"bitbucket.org/qubole/wireguard/internal/logger"
 	"bitbucket.org/qubole/wireguard/internal/router"
+	"bitbucket.org/qubole/wireguard/internal/scheduler"
 	"bitbucket.org/qubole/wireguard/internal/server"
 	"bitbucket.org/qubole/wireguard/internal/workgroup"
 	"bitbucket.org/qubole/wireguard/pkg/api"
@@ -16,7 +22,11 @@ import (
 	"bitbucket.org/qubole/wireguard/pkg/cache"
 	"bitbucket.org/qubole/wireguard/pkg/ip"
 	"bitbucket.org/qubole/wireguard/pkg/wgclient"
+	"bitbucket.org/qubole/wireguard/pkg/wgdevice"
+	"bitbucket.org/qubole/wireguard/pkg/wgquick"
 	"bitbucket.org/qubole/wireguard/pkg/wgserver"
+	"github.com/go-kit/kit/log"
+	"inet.af/netaddr"
 )
 
 // Config struct.
@@ -25,6 +35,42 @@ type Config struct {
 	SSHPrivateKey string `json:"ssh_private_key,omitempty"`
 	SSHPublicKey  string `json:"ssh_public_key,omitempty"`
 	JWTKey        string `json:"jwt_key,omitempty"`
+	JWTIssuer     string `json:"jwt_issuer,omitempty"`
+	JWTAudience   string `json:"jwt_audience,omitempty"`
+	JWTAlgorithms string `json:"jwt_algorithms,omitempty"`
+	JWTPublicKey  string `json:"jwt_public_key,omitempty"`
+	JWKSURL       string `json:"jwks_url,omitempty"`
+	TLSCert       string `json:"tls_cert,omitempty"`
+	TLSKey        string `json:"tls_key,omitempty"`
+	TLSClientCA   string `json:"tls_client_ca,omitempty"`
+	TLSClientOUs  string `json:"tls_client_ous,omitempty"`
+	DefaultPerms  string `json:"default_permissions,omitempty"`
+	AdminGroups   string `json:"admin_groups,omitempty"`
+	ServerID      string `json:"server_id,omitempty"`
+	WGInterface   string `json:"wg_interface,omitempty"`
+	Import        string `json:"import,omitempty"`
+	Store         string `json:"store,omitempty"`
+	RedisAddr     string `json:"redis_addr,omitempty"`
+	RedisPassword string `json:"redis_password,omitempty"`
+	RedisDB       int    `json:"redis_db,omitempty"`
+	BoltPath      string `json:"bolt_path,omitempty"`
+	SnapshotPath  string `json:"snapshot_path,omitempty"`
+	IPPool        string `json:"ip_pool,omitempty"`
+	IPReserved    string `json:"ip_reserved,omitempty"`
+	IPv6Pool      string `json:"ipv6_pool,omitempty"`
+	IPv6Reserved  string `json:"ipv6_reserved,omitempty"`
+
+	IPQuarantine time.Duration `json:"ip_quarantine,omitempty"`
+
+	StorePeersInterval time.Duration `json:"store_peers_interval,omitempty"`
+	SyncPeersInterval  time.Duration `json:"sync_peers_interval,omitempty"`
+	CronJitter         time.Duration `json:"cron_jitter,omitempty"`
+	HeartbeatInterval  time.Duration `json:"heartbeat_interval,omitempty"`
+	HeartbeatTTL       time.Duration `json:"heartbeat_ttl,omitempty"`
+	JanitorInterval    time.Duration `json:"janitor_interval,omitempty"`
+	SnapshotInterval   time.Duration `json:"snapshot_interval,omitempty"`
+	ExpireInterval     time.Duration `json:"expire_interval,omitempty"`
+	JWTTTL             time.Duration `json:"jwt_ttl,omitempty"`
 }
 
 func main() {
@@ -33,34 +79,236 @@ func main() {
 		SSHPublicKey:  "test",
 		SSHPrivateKey: "test",
 		JWTKey:        "test",
+		JWTAlgorithms: "HS256",
+		DefaultPerms:  string(auth.PermClientOwn),
+		WGInterface:   "wg0",
+		Store:         "map",
+		RedisAddr:     "localhost:6379",
+		BoltPath:      "wireguard.db",
+		IPPool:        "10.0.0.0/8",
+		IPReserved:    "10.0.0.1",
+		IPQuarantine:  5 * time.Minute,
+
+		StorePeersInterval: time.Minute,
+		SyncPeersInterval:  30 * time.Second,
+		CronJitter:         5 * time.Second,
+		HeartbeatInterval:  30 * time.Second,
+		HeartbeatTTL:       90 * time.Second,
+		JanitorInterval:    30 * time.Second,
+		SnapshotInterval:   time.Minute,
+		ExpireInterval:     time.Minute,
 	}
+	cfg.ServerID, _ = os.Hostname()
+
 	fs := flag.NewFlagSet("server", flag.PanicOnError)
 	fs.IntVar(&cfg.Port, "port", cfg.Port, "server port")
 	fs.StringVar(&cfg.SSHPublicKey, "pubkey", cfg.SSHPublicKey, "ssh public key")
 	fs.StringVar(&cfg.SSHPrivateKey, "privkey", cfg.SSHPrivateKey, "ssh private key")
 	fs.StringVar(&cfg.JWTKey, "jwtkey", cfg.JWTKey, "jwt key")
+	fs.StringVar(&cfg.JWTIssuer, "jwt-issuer", cfg.JWTIssuer, "iss of jwt tokens, tokens of other issuers are rejected when set")
+	fs.StringVar(&cfg.JWTAudience, "jwt-audience", cfg.JWTAudience, "aud of jwt tokens, tokens for other audiences are rejected when set")
+	fs.StringVar(&cfg.JWTAlgorithms, "jwt-algorithms", cfg.JWTAlgorithms, "comma separated algorithms jwt tokens may be signed with, e.g. RS256,ES256,EdDSA")
+	fs.StringVar(&cfg.JWTPublicKey, "jwt-public-key", cfg.JWTPublicKey, "pem file of rsa, ecdsa or ed25519 public key to verify jwt tokens of identity provider")
+	fs.StringVar(&cfg.JWKSURL, "jwks-url", cfg.JWKSURL, "jwks url of identity provider to verify jwt tokens by their kid")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "pem file of tls certificate, api is served over https when set")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "pem file of tls private key")
+	fs.StringVar(&cfg.TLSClientCA, "tls-client-ca", cfg.TLSClientCA, "pem file of CAs of client certificates, callers with one are authenticated by it instead of jwt")
+	fs.StringVar(&cfg.TLSClientOUs, "tls-client-ous", cfg.TLSClientOUs, "comma separated ou=group of client certificate organizational units granted groups claim values, other OUs grant none")
+	fs.StringVar(&cfg.DefaultPerms, "default-permissions", cfg.DefaultPerms, "comma separated permissions of every authenticated caller: client:own, client:read, client:write, server:admin, token:admin")
+	fs.StringVar(&cfg.AdminGroups, "admin-groups", cfg.AdminGroups, "comma separated groups claim values granted every permission")
+	fs.DurationVar(&cfg.JWTTTL, "jwt-ttl", cfg.JWTTTL, "lifetime of generated jwt tokens, tokens without exp are rejected when set")
+	fs.StringVar(&cfg.ServerID, "id", cfg.ServerID, "wireguard server id")
+	fs.StringVar(&cfg.WGInterface, "wginterface", cfg.WGInterface, "wireguard interface name")
+	fs.DurationVar(&cfg.StorePeersInterval, "store-peers-interval", cfg.StorePeersInterval, "interval to scrape peers from device into store")
+	fs.DurationVar(&cfg.SyncPeersInterval, "sync-peers-interval", cfg.SyncPeersInterval, "interval to sync peers from store onto device")
+	fs.DurationVar(&cfg.CronJitter, "cron-jitter", cfg.CronJitter, "max random delay added to cron intervals")
+	fs.DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", cfg.HeartbeatInterval, "interval this wgserver sends heartbeat once registered")
+	fs.DurationVar(&cfg.HeartbeatTTL, "heartbeat-ttl", cfg.HeartbeatTTL, "wgservers without heartbeat for ttl are dead, 0 keeps all alive")
+	fs.DurationVar(&cfg.ExpireInterval, "expire-interval", cfg.ExpireInterval, "interval to delete expired ephemeral clients and token revocations")
+	fs.StringVar(&cfg.Import, "import", cfg.Import, "comma separated wg-quick server config files to import into store on start")
+	fs.StringVar(&cfg.Store, "store", cfg.Store, "store of clients, servers and ips: map (in memory), redis or bolt (file)")
+	fs.StringVar(&cfg.RedisAddr, "redis-addr", cfg.RedisAddr, "redis address of redis store")
+	fs.StringVar(&cfg.RedisPassword, "redis-password", cfg.RedisPassword, "redis password of redis store")
+	fs.IntVar(&cfg.RedisDB, "redis-db", cfg.RedisDB, "redis database of redis store")
+	fs.StringVar(&cfg.BoltPath, "bolt-path", cfg.BoltPath, "file of bolt store")
+	fs.DurationVar(&cfg.JanitorInterval, "janitor-interval", cfg.JanitorInterval, "interval to evict expired keys of map store and purge them from bolt store")
+	fs.StringVar(&cfg.SnapshotPath, "snapshot-path", cfg.SnapshotPath, "file map store is loaded from on start and saved to, empty keeps it in memory only")
+	fs.DurationVar(&cfg.SnapshotInterval, "snapshot-interval", cfg.SnapshotInterval, "interval to save map store to snapshot file")
+	fs.StringVar(&cfg.IPPool, "ip-pool", cfg.IPPool, "private cidr client ips are allocated from")
+	fs.StringVar(&cfg.IPReserved, "ip-reserved", cfg.IPReserved, "comma separated ips of pool never allocated, e.g. server address")
+	fs.StringVar(&cfg.IPv6Pool, "ipv6-pool", cfg.IPv6Pool, "ula or global ipv6 cidr client ipv6s are allocated from, empty disables dual-stack")
+	fs.StringVar(&cfg.IPv6Reserved, "ipv6-reserved", cfg.IPv6Reserved, "comma separated ipv6s of pool never allocated, e.g. server address")
+	fs.DurationVar(&cfg.IPQuarantine, "ip-quarantine", cfg.IPQuarantine, "time a released client ip is kept before reuse")
+	fs.Parse(os.Args[1:])
+
+	// a non-positive interval would evict in a tight loop, jobs are checked by cron.Add.
+	if cfg.JanitorInterval <= 0 {
+		fmt.Fprintln(os.Stderr, "janitor-interval must be positive")
+		os.Exit(1)
+	}
+
+	// without a certificate api is plain http, client certificates would never be seen.
+	if cfg.TLSCert == "" && (cfg.TLSKey != "" || cfg.TLSClientCA != "") {
+		fmt.Fprintln(os.Stderr, "tls-key and tls-client-ca need tls-cert")
+		os.Exit(1)
+	}
+
+	ouGroups, err := parseOUGroups(cfg.TLSClientOUs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	// set cache
-	c := cache.NewMap()
+	c, err := newStore(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	// set ipsvc
-	ipsvc := ip.NewSvc(c)
+	ipsvc, err := newIPSvc(c, cfg.IPPool, cfg.IPReserved, cfg.IPQuarantine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// set wireguard device
+	device := wgdevice.NewUAPI(cfg.WGInterface)
 
 	// set wireguard server service
-	wgs := wgserver.NewSvc(c, ipsvc, cfg.SSHPublicKey, cfg.SSHPrivateKey)
+	wgs := wgserver.NewSvc(cfg.ServerID, c, ipsvc, device, cfg.SSHPublicKey, cfg.SSHPrivateKey)
+	wgs.SetHeartbeatTTL(cfg.HeartbeatTTL)
 
 	// set wireguard client service
 	wgc := wgclient.NewSvc(c, ipsvc, wgs)
+	if cfg.IPv6Pool != "" {
+		ipv6svc, err := newIPSvc(c, cfg.IPv6Pool, cfg.IPv6Reserved, cfg.IPQuarantine)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		wgc.SetIPv6(ipv6svc)
+	}
+
+	// import existing wg-quick configs
+	if cfg.Import != "" {
+		err := importConfigs(context.Background(), strings.Split(cfg.Import, ","), cfg.ServerID, wgc, wgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 
 	// set jwt
 	jwt := auth.NewJWT(cfg.JWTKey)
+	jwt.SetIssuer(cfg.JWTIssuer)
+	jwt.SetAudience(cfg.JWTAudience)
+	jwt.SetTTL(cfg.JWTTTL)
+	jwt.SetAlgorithms(strings.Split(cfg.JWTAlgorithms, ",")...)
+	if cfg.JWTPublicKey != "" {
+		data, err := ioutil.ReadFile(cfg.JWTPublicKey)
+		if err == nil {
+			err = jwt.SetPublicKeyPEM(data)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if cfg.JWKSURL != "" {
+		jwt.SetKeySource(auth.NewJWKS(cfg.JWKSURL))
+	}
+
+	// set revoked tokens, kept in store so that all instances reject them
+	revocations := auth.NewRevocations(c)
+	jwt.SetRevocationList(revocations)
+
+	// set policy of claims
+	policy := auth.NewPolicy()
+	perms, err := auth.ParsePermissions(cfg.DefaultPerms)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	policy.SetDefault(perms...)
+	for _, g := range strings.Split(cfg.AdminGroups, ",") {
+		if g != "" {
+			policy.GrantGroup(g, auth.AllPermissions...)
+		}
+	}
+
+	// set api keys of services
+	apikeys := auth.NewAPIKeys(c, policy)
+	apikeys.SetRevocationList(revocations)
+
+	// set cron jobs
+	cronLogger := log.With(logger.Create("info"), "app", "wireguard", "type", "scheduler")
+	cron := scheduler.New(cronLogger)
+	jobs := []scheduler.Job{
+		{
+			Name: "store_peers", Interval: cfg.StorePeersInterval, Jitter: cfg.CronJitter,
+			Fn: wgs.CronStorePeers,
+		},
+		{
+			Name: "sync_peers", Interval: cfg.SyncPeersInterval, Jitter: cfg.CronJitter,
+			Fn: func(ctx context.Context) error {
+				sum, err := wgs.CronSyncPeersFromStore(ctx)
+				if sum != nil {
+					cronLogger.Log("job", "sync_peers", "added", sum.Added, "updated", sum.Updated, "removed", sum.Removed, "failed", sum.Failed)
+				}
+				return err
+			},
+		},
+		{
+			Name: "heartbeat", Interval: cfg.HeartbeatInterval, Jitter: cfg.CronJitter,
+			Fn: wgs.CronHeartbeat,
+		},
+		{
+			Name: "expire_clients", Interval: cfg.ExpireInterval, Jitter: cfg.CronJitter,
+			Fn: wgc.CronExpire,
+		},
+		{
+			Name: "cleanup_revocations", Interval: cfg.ExpireInterval, Jitter: cfg.CronJitter,
+			Fn: revocations.CronCleanup,
+		},
+	}
+	if m, ok := c.(*cache.Map); ok && cfg.SnapshotPath != "" {
+		jobs = append(jobs, scheduler.Job{
+			Name: "snapshot", Interval: cfg.SnapshotInterval, Jitter: cfg.CronJitter,
+			Fn: func(ctx context.Context) error {
+				return m.SaveFile(cfg.SnapshotPath)
+			},
+		})
+	}
+	if b, ok := c.(*cache.Bolt); ok {
+		jobs = append(jobs, scheduler.Job{
+			Name: "purge_store", Interval: cfg.JanitorInterval, Jitter: cfg.CronJitter,
+			Fn: b.DeleteExpired,
+		})
+	}
+	for _, j := range jobs {
+		if err := cron.Add(j); err != nil {
+			fmt.Fprintf(os.Stderr, "cron:%s:%v\n", j.Name, err)
+			os.Exit(1)
+		}
+	}
 
 	// set REST api handler.
-	rapi := &api.REST{WGC: wgc, WGS: wgs}
+	rapi := &api.REST{WGC: wgc, WGS: wgs, Jobs: cron, Revocations: revocations, APIKeys: apikeys}
 
 	// set  routes
 	router := router.CreateRouter("gorilla")
-	setRoutes(router, rapi, jwt)
+	// api keys, else client certificates, else jwt
+	authn := jwt.HTTPMiddleware
+	if cfg.TLSClientCA != "" {
+		cc := auth.NewClientCert()
+		cc.SetGroups(ouGroups)
+		cc.SetFallback(authn)
+		authn = cc.HTTPMiddleware
+	}
+	apikeys.SetFallback(authn)
+	setRoutes(router, rapi, apikeys.HTTPMiddleware, policy)
 
 	// start server
 
@@ -78,17 +326,167 @@ func main() {
 	})
 
 	//// create server object
-	s := server.New(server.Logger("info", "app", "wireguard", "type", "server"), server.Port(cfg.Port), server.NotFoundHandler(router))
+	opts := []server.Option{server.Logger("info", "app", "wireguard", "type", "server"), server.Port(cfg.Port), server.NotFoundHandler(router)}
+	if cfg.TLSCert != "" {
+		opts = append(opts, server.TLS(cfg.TLSCert, cfg.TLSKey), server.ClientCA(cfg.TLSClientCA))
+	}
+	s := server.New(opts...)
 	for _, fn := range s.Runnables() {
 		g.Add(fn)
 	}
 
+	//// add cron jobs
+	for _, fn := range cron.Runnables() {
+		g.Add(fn)
+	}
+
+	//// evict expired keys of map, redis expires keys itself and bolt ones are purged by purge_store job
+	if m, ok := c.(*cache.Map); ok {
+		g.Add(m.Janitor(cfg.JanitorInterval))
+	}
+
 	//// run workgroup
 	g.Run()
+
+	//// save map on shutdown
+	if m, ok := c.(*cache.Map); ok && cfg.SnapshotPath != "" {
+		if err := m.SaveFile(cfg.SnapshotPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// parseOUGroups of comma separated ou=group list of a flag.
+func parseOUGroups(s string) (map[string]string, error) {
+	groups := map[string]string{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("tls-client-ous:%q is not ou=group", v)
+		}
+		groups[kv[0]] = kv[1]
+	}
+	return groups, nil
+}
+
+// newStore creates store of cfg.Store.
+func newStore(cfg *Config) (cache.Store, error) {
+	switch cfg.Store {
+	case "map":
+		m := cache.NewMap()
+		if cfg.SnapshotPath != "" {
+			if err := m.LoadFile(cfg.SnapshotPath); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case "redis":
+		r := cache.NewRedis(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB)
+		if err := r.Ping(context.Background()); err != nil {
+			return nil, fmt.Errorf("redis:%v", err)
+		}
+		return r, nil
+	case "bolt":
+		return cache.NewBolt(cfg.BoltPath, &wgclient.WGClient{}, &wgserver.WGServer{}, &wgserver.WGPeerStatus{}, &auth.Revocation{}, &auth.APIKey{}, &ip.Released{})
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Store)
+	}
+}
+
+// newIPSvc allocates ips of pool cidr except comma separated reserved ips.
+func newIPSvc(store ip.Store, pool, reserved string, quarantine time.Duration) (*ip.Svc, error) {
+	prefix, err := netaddr.ParseIPPrefix(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	var rs []string
+	if reserved != "" {
+		rs = strings.Split(reserved, ",")
+	}
+
+	s, err := ip.NewSvc(store, prefix, rs...)
+	if err != nil {
+		return nil, err
+	}
+	s.SetQuarantine(quarantine)
+	return s, nil
+}
+
+// importConfigs loads interface of each wg-quick config as wgserver and its peers as wgclients.
+// Configs are all checked first, peers which are not clients, e.g. site-to-site peers, would be
+// removed from device by sync of peers, so nothing is imported when a config has one.
+func importConfigs(ctx context.Context, paths []string, serverID string, wgc *wgclient.Svc, wgs *wgserver.Svc) error {
+	configs := make([]*wgquick.Config, 0, len(paths))
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("import:%s:%v", p, err)
+		}
+
+		c, err := wgquick.Unmarshal(b)
+		if err != nil {
+			return fmt.Errorf("import:%s:%v", p, err)
+		}
+
+		if others := c.OtherPeers(); len(others) > 0 {
+			ps := make([]string, 0, len(others))
+			for _, o := range others {
+				ps = append(ps, fmt.Sprintf("%s (%s)", o.PublicKey, strings.Join(o.AllowedIPs, ",")))
+			}
+			return fmt.Errorf("import:%s:peers are not clients of a single host ip:%s", p, strings.Join(ps, ", "))
+		}
+		configs = append(configs, c)
+	}
+
+	for i, c := range configs {
+		p := paths[i]
+
+		srv, err := c.WGServer(serverID)
+		if err != nil {
+			return fmt.Errorf("import:%s:wgserver:%v", p, err)
+		}
+		if srv.PrivateIP != "" {
+			if err := wgs.Import(ctx, srv); err != nil {
+				return fmt.Errorf("import:%s:wgserver:%v", p, err)
+			}
+		}
+
+		for _, cl := range c.WGClients() {
+			if err := wgc.Import(ctx, cl); err != nil {
+				return fmt.Errorf("import:%s:wgclient:%s:%v", p, cl.ID, err)
+			}
+		}
+	}
+	return nil
 }
 
-func setRoutes(r router.Router, rapi *api.REST, jwt *auth.JWT) {
-	r.Handle("post", "/wgclient", jwt.HTTPMiddleware(rapi.ClientGererateConfig()))
+// setRoutes of api, authn is auth middleware putting claims of caller in context.
+func setRoutes(r router.Router, rapi *api.REST, authn func(http.Handler) http.Handler, policy *auth.Policy) {
+	// authenticate caller and derive its permissions from claims.
+	authz := func(h http.Handler) http.Handler {
+		return authn(policy.HTTPMiddleware(h))
+	}
+
+	r.Handle("post", "/wgclient", authz(rapi.ClientGererateConfig()))
+	r.Handle("get", "/wgclient", authz(rapi.ClientList()))
+	r.Handle("get", router.FormatPath(r.Name(), "/wgclient/:id"), authz(rapi.ClientGet()))
+	r.Handle("patch", router.FormatPath(r.Name(), "/wgclient/:id"), authz(rapi.ClientUpdate()))
+	r.Handle("delete", router.FormatPath(r.Name(), "/wgclient/:id"), authz(rapi.ClientDelete()))
+	r.Handle("post", "/wgserver", authz(rapi.ServerCreate()))
+	r.Handle("post", router.FormatPath(r.Name(), "/wgserver/:id/heartbeat"), authz(rapi.ServerHeartbeat()))
+	r.Handle("get", "/status/wgservers", authz(rapi.ServerStatus()))
+	r.Handle("get", "/status/jobs", authz(rapi.JobStatus()))
+	r.Handle("post", "/token/revoke", authz(rapi.TokenRevoke()))
+	r.Handle("post", "/apikey", authz(rapi.APIKeyCreate()))
+	r.Handle("get", "/apikey", authz(rapi.APIKeyList()))
+	r.Handle("delete", router.FormatPath(r.Name(), "/apikey/:id"), authz(rapi.APIKeyRevoke()))
 
 	r.Handle("get", "/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+	"bitbucket.org/qubole/wireguard/pkg/ip"
+	"bitbucket.org/qubole/wireguard/pkg/wgclient"
+	"bitbucket.org/qubole/wireguard/pkg/wgdevice"
+	"bitbucket.org/qubole/wireguard/pkg/wgserver"
+	"inet.af/netaddr"
+)
+
+func TestImportConfigs(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := `[Interface]
+Address = 10.33.0.1/24
+PrivateKey = 2G7+CIjVzksQZ7tG2kaiJfQ59BzjZHtPLi5Kzi/s6VU=
+ListenPort = 51820
+
+[Peer]
+# Name = laptop
+PublicKey = ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0=
+AllowedIPs = 10.33.0.2/32
+`
+	site := `[Interface]
+Address = 10.33.0.1/24
+
+[Peer]
+# Name = phone
+PublicKey = 4NkU0MYF3sdB28TL5qibSOA6aHMiHj/5MCQ8Qr87O3Y=
+AllowedIPs = 10.33.0.3/32
+
+[Peer]
+PublicKey = zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8=
+AllowedIPs = 192.168.10.0/24
+`
+	files := map[string]string{}
+	for name, data := range map[string]string{"server": server, "site": site, "invalid": "[Foo]\n"} {
+		files[name] = filepath.Join(dir, name+".conf")
+		if err := ioutil.WriteFile(files[name], []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		paths       []string
+		wantClients []string
+		wantServer  bool
+		wantErr     string
+	}{
+		{name: "TestImportConfigs", paths: []string{files["server"]}, wantClients: []string{"laptop"}, wantServer: true},
+		{name: "TestImportConfigsAgain", paths: []string{files["server"], files["server"]}, wantClients: []string{"laptop"}, wantServer: true},
+		{name: "TestImportConfigsSiteToSite", paths: []string{files["server"], files["site"]}, wantErr: "zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8= (192.168.10.0/24)"},
+		{name: "TestImportConfigsInvalid", paths: []string{files["invalid"]}, wantErr: "unknown section"},
+		{name: "TestImportConfigsMissing", paths: []string{filepath.Join(dir, "missing.conf")}, wantErr: "missing.conf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cache.NewMap()
+			pool, _ := netaddr.ParseIPPrefix("10.33.0.0/24")
+			ips, err := ip.NewSvc(c, pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wgs := wgserver.NewSvc("wg-1", c, ips, wgdevice.NewFake("wg0", 51820), "test", "test")
+			wgc := wgclient.NewSvc(c, ips, wgs)
+
+			err = importConfigs(ctx, tt.paths, "wg-1", wgc, wgs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("importConfigs() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("importConfigs() error = %v", err)
+			}
+
+			// nothing is imported when a config can not be.
+			out, err := wgc.List(ctx, &wgclient.ListInput{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, cl := range out.Clients {
+				got = append(got, cl.ID)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.wantClients, ",") {
+				t.Errorf("importConfigs() clients = %v, want %v", got, tt.wantClients)
+			}
+
+			srv, err := wgs.Server(ctx, "wg-1")
+			if err != nil || (srv != nil) != tt.wantServer {
+				t.Errorf("importConfigs() server = %+v, %v, want %v", srv, err, tt.wantServer)
+			}
+		})
+	}
+}
@@ -2,17 +2,29 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"bitbucket.org/qubole/wireguard/internal/router"
+	"bitbucket.org/qubole/wireguard/internal/scheduler"
+	"bitbucket.org/qubole/wireguard/pkg/auth"
+	"bitbucket.org/qubole/wireguard/pkg/ip"
 	"bitbucket.org/qubole/wireguard/pkg/wgclient"
+	"bitbucket.org/qubole/wireguard/pkg/wgquick"
 	"bitbucket.org/qubole/wireguard/pkg/wgserver"
 )
 
 // REST apis
 type REST struct {
-	WGS *wgserver.Svc
-	WGC *wgclient.Svc
+	WGS         *wgserver.Svc
+	WGC         *wgclient.Svc
+	Jobs        *scheduler.Scheduler
+	Revocations *auth.Revocations
+	APIKeys     *auth.APIKeys
 }
 
 // StatusHandler is for any http status code.
@@ -30,18 +42,28 @@ func (s StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // Input:
 // // {
 // // 	"id": "5",
-// // 	"public_key": "dhfjdbfjdbffg"
+// // 	"public_key": "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0="
 // // }
+// public_key can be omitted to get a server generated keypair, its private_key is returned only once.
+// "generate_preshared_key": true adds a preshared key.
+// "ttl": 600 (seconds) or "expires_at": "2020-06-01T10:00:00Z" makes an ephemeral client,
+// it is deleted with its ip and peer on expiry, client has "expires_at" then.
 // Output:
 // //   {
-// //    "id": "5",
-// //    "private_ip": "10.0.0.3",
+// //    "client": {
+// //        "id": "5",
+// //        "private_ip": "10.0.0.3",
+// //        "public_key": "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0="
+// //    },
 // //    "ssh_authorized_keys": [
 // //        "test1",
 // //        "test2"
 // //    ],
-// //    "public_key": "dhfjdbfjdbffg"
+// //    "peers": [...]
 // }
+// With "Accept: text/plain" header or "?format=wgquick" query, output is wg-quick(8) config file.
+// Callers without client:write permission may only create the client of their identity,
+// id defaults to it.
 func (h *REST) ClientGererateConfig() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var in wgclient.GenerateConfigInput
@@ -52,9 +74,23 @@ func (h *REST) ClientGererateConfig() http.Handler {
 			return
 		}
 
+		caller := auth.CallerFrom(r.Context())
+		if in.ID == "" && !caller.Can(auth.PermClientWrite) {
+			in.ID = caller.Subject
+		}
+		if err := caller.AuthorizeClient(in.ID, true); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
 		out, err := h.WGC.GenerateConfig(r.Context(), &in)
 		if err != nil {
-			writeError(fmt.Errorf("wgclient:create:%v", err), http.StatusBadRequest, w)
+			writeError(fmt.Errorf("wgclient:create:%v", err), clientStatus(err), w)
+			return
+		}
+
+		if wantWGQuick(r) {
+			writeText(wgquick.Marshal(wgquick.FromGenerateConfig(out)), w)
 			return
 		}
 
@@ -62,6 +98,405 @@ func (h *REST) ClientGererateConfig() http.Handler {
 	})
 }
 
+// ClientGet returns wgclient of path param id:
+// Output:
+// // {
+// //   "id": "5",
+// //   "private_ip": "10.0.0.3",
+// //   "public_key": "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0=",
+// //   "labels": {"team": "data"}
+// // }
+func (h *REST) ClientGet() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := router.Param(r, "id")
+		if err := auth.CallerFrom(r.Context()).AuthorizeClient(id, false); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
+		c, err := h.WGC.Get(r.Context(), id)
+		if err != nil {
+			writeError(fmt.Errorf("wgclient:get:%v", err), clientStatus(err), w)
+			return
+		}
+
+		writeRespone(c, w)
+	})
+}
+
+// ClientList returns a page of wgclients ordered by id:
+// Input: "?limit=50&after=5&label=team=data", label can be repeated.
+// Output:
+// // {
+// //   "clients": [...],
+// //   "next": "55"
+// // }
+// next is after of next page, it is omitted on last page.
+func (h *REST) ClientList() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.CallerFrom(r.Context()).Authorize(auth.PermClientRead, "wgclient"); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
+		q := r.URL.Query()
+		in := wgclient.ListInput{After: q.Get("after"), Labels: map[string]string{}}
+
+		if l := q.Get("limit"); l != "" {
+			limit, err := strconv.Atoi(l)
+			if err != nil {
+				writeError(fmt.Errorf("wgclient:list:limit:%v", err), http.StatusBadRequest, w)
+				return
+			}
+			in.Limit = limit
+		}
+
+		for _, l := range q["label"] {
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 {
+				writeError(fmt.Errorf("wgclient:list:label:%q is not key=value", l), http.StatusBadRequest, w)
+				return
+			}
+			in.Labels[kv[0]] = kv[1]
+		}
+
+		out, err := h.WGC.List(r.Context(), &in)
+		if err != nil {
+			writeError(fmt.Errorf("wgclient:list:%v", err), clientStatus(err), w)
+			return
+		}
+
+		writeRespone(out, w)
+	})
+}
+
+// ClientUpdate updates wgclient of path param id:
+// Input:
+// // {
+// // 	"dns_servers": ["10.90.0.5"],
+// // 	"labels": {"team": "data", "old": ""},
+// // 	"public_key": "zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8="
+// // }
+// every field is optional, a label with empty value is removed.
+// "rotate_key": true instead of public_key rotates to a server generated keypair, its private_key is returned only once.
+// Output:
+// // {
+// //   "client": {...},
+// //   "private_key": "..."
+// // }
+func (h *REST) ClientUpdate() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := router.Param(r, "id")
+		if err := auth.CallerFrom(r.Context()).AuthorizeClient(id, true); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
+		var in wgclient.UpdateInput
+
+		err := json.NewDecoder(r.Body).Decode(&in)
+		if err != nil {
+			writeError(fmt.Errorf("wgclient:update:%v", err), http.StatusBadRequest, w)
+			return
+		}
+
+		out, err := h.WGC.Update(r.Context(), id, &in)
+		if err != nil {
+			writeError(fmt.Errorf("wgclient:update:%v", err), clientStatus(err), w)
+			return
+		}
+
+		writeRespone(out, w)
+	})
+}
+
+// ClientDelete deletes wgclient of path param id and returns it, its IP is released.
+func (h *REST) ClientDelete() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := router.Param(r, "id")
+		if err := auth.CallerFrom(r.Context()).AuthorizeClient(id, true); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
+		c, err := h.WGC.Delete(r.Context(), id)
+		if err != nil {
+			writeError(fmt.Errorf("wgclient:delete:%v", err), clientStatus(err), w)
+			return
+		}
+
+		writeRespone(c, w)
+	})
+}
+
+// ServerCreate registers a wgserver, its peer is returned to every wgclient afterwards:
+// Input:
+// // {
+// // 	"id": "wg-1",
+// // 	"public_key": "8AnbIFIos5HjXibVWBjRxJhdqw/evd1pXsNCRvBmCnI=",
+// // 	"endpoint": "34.93.47.5",
+// // 	"listen_port": 51820,
+// // 	"private_ip": "10.0.0.1",
+// // 	"cidrs": ["10.0.0.0/8"]
+// // }
+// private_ip is allocated when omitted, listen_port defaults to 51820.
+// Output:
+// // {
+// //   "server": {...}
+// // }
+func (h *REST) ServerCreate() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.CallerFrom(r.Context()).Authorize(auth.PermServerAdmin, "wgserver"); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
+		var in wgserver.CreateInput
+
+		err := json.NewDecoder(r.Body).Decode(&in)
+		if err != nil {
+			writeError(fmt.Errorf("wgserver:create:%v", err), http.StatusBadRequest, w)
+			return
+		}
+
+		out, err := h.WGS.Create(r.Context(), &in)
+		if err != nil {
+			writeError(fmt.Errorf("wgserver:create:%v", err), clientStatus(err), w)
+			return
+		}
+
+		writeRespone(out, w)
+	})
+}
+
+// ServerHeartbeat marks wgserver of path param id alive, servers call it more often than heartbeat ttl:
+// Output:
+// // {
+// //   "id": "wg-1",
+// //   "endpoint": "34.93.47.5",
+// //   ...
+// //   "alive": true,
+// //   "last_heartbeat": "2020-06-10T10:00:00Z"
+// // }
+func (h *REST) ServerHeartbeat() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := router.Param(r, "id")
+		if err := auth.CallerFrom(r.Context()).Authorize(auth.PermServerAdmin, "wgserver:"+id); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
+		st, err := h.WGS.Heartbeat(r.Context(), id)
+		if err != nil {
+			writeError(fmt.Errorf("wgserver:heartbeat:%v", err), clientStatus(err), w)
+			return
+		}
+
+		writeRespone(st, w)
+	})
+}
+
+// ServerStatus returns liveness of every registered wgserver, dead ones are not given to wgclients:
+// Output:
+// // [
+// //   {
+// //     "id": "wg-1",
+// //     ...
+// //     "alive": false,
+// //     "last_heartbeat": "2020-06-10T10:00:00Z"
+// //   }
+// // ]
+func (h *REST) ServerStatus() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.CallerFrom(r.Context()).Authorize(auth.PermServerAdmin, "wgserver"); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
+		st, err := h.WGS.ServerStatus(r.Context())
+		if err != nil {
+			writeError(fmt.Errorf("wgserver:status:%v", err), http.StatusInternalServerError, w)
+			return
+		}
+
+		writeRespone(st, w)
+	})
+}
+
+// JobStatus returns last run of every cron job:
+// Output:
+// // [
+// //   {
+// //     "name": "sync_peers",
+// //     "interval": 30000000000,
+// //     "running": false,
+// //     "runs": 12,
+// //     "skipped": 0,
+// //     "last_run": "2020-06-10T10:00:00Z",
+// //     "last_duration": 1250000,
+// //     "last_error": "device:get:wireguard device not found"
+// //   }
+// // ]
+func (h *REST) JobStatus() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.CallerFrom(r.Context()).Authorize(auth.PermServerAdmin, "jobs"); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
+		writeRespone(h.Jobs.Status(), w)
+	})
+}
+
+// TokenRevoke revokes a token by its jti, or every token of a subject issued so far:
+// Input:
+// // {
+// //   "jti": "9f86d081884c7d659a2feaa0c55ad015",
+// //   "expires_at": "2020-06-01T10:00:00Z"
+// // }
+// or
+// // {
+// //   "sub": "ci-runner"
+// // }
+// expires_at is exp of token, revocation is kept till then. Revocations of subjects,
+// and of tokens without expires_at, are kept for good.
+// Output:
+// // {
+// //   "jti": "9f86d081884c7d659a2feaa0c55ad015",
+// //   "revoked_at": "2020-05-31T10:00:00Z",
+// //   "expires_at": "2020-06-01T10:00:00Z"
+// // }
+func (h *REST) TokenRevoke() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.CallerFrom(r.Context()).Authorize(auth.PermTokenAdmin, "token"); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
+		var in struct {
+			JTI       string    `json:"jti"`
+			Subject   string    `json:"sub"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&in)
+		if err != nil {
+			writeError(fmt.Errorf("token:revoke:%v", err), http.StatusBadRequest, w)
+			return
+		}
+
+		rv, err := h.Revocations.Revoke(r.Context(), in.JTI, in.Subject, in.ExpiresAt)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if err == auth.ErrRevocationInvalid {
+				status = http.StatusBadRequest
+			}
+			writeError(fmt.Errorf("token:revoke:%v", err), status, w)
+			return
+		}
+
+		writeRespone(rv, w)
+	})
+}
+
+// APIKeyCreate creates an api key of scopes:
+// Input:
+// // {
+// //   "name": "ci",
+// //   "sub": "ci-runner",
+// //   "scopes": ["wireguard:client:write"]
+// // }
+// sub defaults to apikey:<id>, setting it needs client:write. Scopes may only grant permissions
+// caller has, 403 otherwise. "ttl": 600 (seconds) or "expires_at": "2020-06-01T10:00:00Z" make key expire.
+// Output has key, it is sent in X-API-Key header and returned only once:
+// // {
+// //   "id": "3f9a2c1b7d4e8f60",
+// //   "name": "ci",
+// //   "sub": "ci-runner",
+// //   "scopes": ["wireguard:client:write"],
+// //   "created_at": "2020-06-01T10:00:00Z",
+// //   "key": "wgk_3f9a2c1b7d4e8f60.Zm9vYmFy..."
+// // }
+func (h *REST) APIKeyCreate() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.CallerFrom(r.Context()).Authorize(auth.PermTokenAdmin, "apikey"); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
+		var in auth.CreateAPIKeyInput
+
+		err := json.NewDecoder(r.Body).Decode(&in)
+		if err != nil {
+			writeError(fmt.Errorf("apikey:create:%v", err), http.StatusBadRequest, w)
+			return
+		}
+
+		k, err := h.APIKeys.Create(r.Context(), auth.CallerFrom(r.Context()), &in)
+		if _, ok := err.(*auth.ForbiddenError); ok {
+			writeForbidden(err, w)
+			return
+		}
+		if err != nil {
+			writeError(fmt.Errorf("apikey:create:%v", err), http.StatusBadRequest, w)
+			return
+		}
+
+		writeRespone(k, w)
+	})
+}
+
+// APIKeyList returns api keys without their secrets:
+// Output:
+// // [
+// //   {
+// //     "id": "3f9a2c1b7d4e8f60",
+// //     "name": "ci",
+// //     "sub": "ci-runner",
+// //     "scopes": ["wireguard:client:write"],
+// //     "created_at": "2020-06-01T10:00:00Z"
+// //   }
+// // ]
+func (h *REST) APIKeyList() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.CallerFrom(r.Context()).Authorize(auth.PermTokenAdmin, "apikey"); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
+		keys, err := h.APIKeys.List(r.Context())
+		if err != nil {
+			writeError(fmt.Errorf("apikey:list:%v", err), http.StatusInternalServerError, w)
+			return
+		}
+
+		writeRespone(keys, w)
+	})
+}
+
+// APIKeyRevoke deletes api key of path param id, it is rejected from then on.
+func (h *REST) APIKeyRevoke() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := router.Param(r, "id")
+		if err := auth.CallerFrom(r.Context()).Authorize(auth.PermTokenAdmin, "apikey:"+id); err != nil {
+			writeForbidden(err, w)
+			return
+		}
+
+		k, err := h.APIKeys.Revoke(r.Context(), id)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if err == auth.ErrAPIKeyNotFound {
+				status = http.StatusNotFound
+			}
+			writeError(fmt.Errorf("apikey:revoke:%v", err), status, w)
+			return
+		}
+
+		writeRespone(k, w)
+	})
+}
+
 // writeError writes error on ResponseWriter
 func writeError(err error, status int, w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -71,9 +506,64 @@ func writeError(err error, status int, w http.ResponseWriter) {
 	})
 }
 
+// writeForbidden writes 403 with what caller lacks:
+// // {
+// //   "error": "forbidden:ci-runner lacks client:own on wgclient:5",
+// //   "forbidden": {"subject": "ci-runner", "permission": "client:own", "resource": "wgclient:5"}
+// // }
+func writeForbidden(err error, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":     err.Error(),
+		"forbidden": err,
+	})
+}
+
 // writeError writes error on ResponseWriter
 func writeRespone(data interface{}, w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(data)
 }
+
+// writeText writes plain text on ResponseWriter
+func writeText(data []byte, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// clientStatus is http status of wgclient or wgserver error: 400 only for invalid input,
+// 503 when ip pool is exhausted, 409 when an ip to reserve is in use and 500 for store
+// or device failures, which are not a fault of caller.
+func clientStatus(err error) int {
+	if err == wgclient.ErrNotFound || err == wgserver.ErrNotFound {
+		return http.StatusNotFound
+	}
+	if err == wgserver.ErrInvalidID {
+		return http.StatusBadRequest
+	}
+	var clientInvalid *wgclient.ValidationError
+	var serverInvalid *wgserver.ValidationError
+	if errors.As(err, &clientInvalid) || errors.As(err, &serverInvalid) {
+		return http.StatusBadRequest
+	}
+	var exhausted *ip.ExhaustedError
+	if errors.As(err, &exhausted) {
+		return http.StatusServiceUnavailable
+	}
+	var conflict *ip.ConflictError
+	if errors.As(err, &conflict) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// wantWGQuick tells if client asked for wg-quick config instead of json.
+func wantWGQuick(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return strings.ToLower(f) == "wgquick"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/plain")
+}
@@ -0,0 +1,264 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"bitbucket.org/qubole/wireguard/internal/contextutils"
+	"bitbucket.org/qubole/wireguard/internal/router"
+	"bitbucket.org/qubole/wireguard/pkg/api"
+	"bitbucket.org/qubole/wireguard/pkg/auth"
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+	"bitbucket.org/qubole/wireguard/pkg/ip"
+	"bitbucket.org/qubole/wireguard/pkg/wgclient"
+	"bitbucket.org/qubole/wireguard/pkg/wgdevice"
+	"bitbucket.org/qubole/wireguard/pkg/wgserver"
+	"inet.af/netaddr"
+)
+
+const pk = "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0="
+
+// brokenStore fails like a store whose backend is down.
+type brokenStore struct {
+	*cache.Map
+}
+
+func (brokenStore) Get(context.Context, string) (interface{}, error) {
+	return nil, errors.New("store down")
+}
+
+func (brokenStore) Update(context.Context, func(cache.Tx) error) error {
+	return errors.New("store down")
+}
+
+// newHandler routes REST of a pool like main does, claims of caller are sub and scope headers.
+// Clients are kept in a broken store if broken is set.
+func newHandler(t *testing.T, pool string, broken bool) http.Handler {
+	prefix, err := netaddr.ParseIPPrefix(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.NewMap()
+	ips, err := ip.NewSvc(c, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wgs := wgserver.NewSvc("wg-1", c, ips, wgdevice.NewFake("wg0", 51820), "test", "test")
+	var clients cache.Store = c
+	if broken {
+		clients = brokenStore{c}
+	}
+	rapi := &api.REST{WGS: wgs, WGC: wgclient.NewSvc(clients, ips, wgs)}
+
+	policy := auth.NewPolicy()
+	authz := func(next http.Handler) http.Handler {
+		next = policy.HTTPMiddleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := map[string]interface{}{"sub": r.Header.Get("sub"), "scope": r.Header.Get("scope")}
+			next.ServeHTTP(w, r.WithContext(contextutils.Set(r.Context(), contextutils.Params, claims)))
+		})
+	}
+
+	r := router.CreateRouter("gorilla")
+	r.Handle("post", "/wgclient", authz(rapi.ClientGererateConfig()))
+	r.Handle("get", router.FormatPath(r.Name(), "/wgclient/:id"), authz(rapi.ClientGet()))
+	r.Handle("post", "/wgserver", authz(rapi.ServerCreate()))
+	return r
+}
+
+func TestREST(t *testing.T) {
+	tests := []struct {
+		name          string
+		pool          string
+		broken        bool
+		setup         []string
+		method        string
+		path          string
+		header        map[string]string
+		body          string
+		wantStatus    int
+		wantType      string
+		wantBody      string
+		wantForbidden *auth.ForbiddenError
+	}{
+		{
+			name:       "TestClientCreateJSON",
+			method:     "post",
+			path:       "/wgclient",
+			header:     map[string]string{"sub": "5"},
+			body:       `{"public_key": "` + pk + `"}`,
+			wantStatus: http.StatusOK,
+			wantType:   "application/json",
+			wantBody:   `"id":"5"`,
+		},
+		{
+			name:       "TestClientCreateFormatWGQuick",
+			method:     "post",
+			path:       "/wgclient?format=wgquick",
+			header:     map[string]string{"sub": "5"},
+			body:       `{"public_key": "` + pk + `"}`,
+			wantStatus: http.StatusOK,
+			wantType:   "text/plain",
+			wantBody:   "[Interface]",
+		},
+		{
+			name:       "TestClientCreateAcceptText",
+			method:     "post",
+			path:       "/wgclient",
+			header:     map[string]string{"sub": "5", "Accept": "text/plain"},
+			body:       `{"public_key": "` + pk + `"}`,
+			wantStatus: http.StatusOK,
+			wantType:   "text/plain",
+			wantBody:   "[Interface]",
+		},
+		{
+			name:       "TestClientCreateFormatOverridesAccept",
+			method:     "post",
+			path:       "/wgclient?format=json",
+			header:     map[string]string{"sub": "5", "Accept": "text/plain"},
+			body:       `{"public_key": "` + pk + `"}`,
+			wantStatus: http.StatusOK,
+			wantType:   "application/json",
+			wantBody:   `"id":"5"`,
+		},
+		{
+			name:          "TestClientCreateForbidden",
+			method:        "post",
+			path:          "/wgclient",
+			header:        map[string]string{"sub": "6"},
+			body:          `{"id": "5", "public_key": "` + pk + `"}`,
+			wantStatus:    http.StatusForbidden,
+			wantType:      "application/json",
+			wantForbidden: &auth.ForbiddenError{Subject: "6", Permission: auth.PermClientOwn, Resource: "wgclient:5"},
+		},
+		{
+			name:       "TestClientCreateEmptyID",
+			method:     "post",
+			path:       "/wgclient",
+			header:     map[string]string{"sub": "ci", "scope": "wireguard:client:write"},
+			body:       `{"public_key": "` + pk + `"}`,
+			wantStatus: http.StatusBadRequest,
+			wantType:   "application/json",
+			wantBody:   "id:empty",
+		},
+		{
+			name:       "TestClientCreateExhausted",
+			pool:       "10.33.0.0/30",
+			setup:      []string{"1", "2"},
+			method:     "post",
+			path:       "/wgclient",
+			header:     map[string]string{"sub": "3"},
+			body:       `{}`,
+			wantStatus: http.StatusServiceUnavailable,
+			wantType:   "application/json",
+			wantBody:   "exhausted",
+		},
+		{
+			name:       "TestClientCreateStoreDown",
+			broken:     true,
+			method:     "post",
+			path:       "/wgclient",
+			header:     map[string]string{"sub": "5"},
+			body:       `{}`,
+			wantStatus: http.StatusInternalServerError,
+			wantType:   "application/json",
+			wantBody:   "store down",
+		},
+		{
+			name:       "TestClientGetStoreDown",
+			broken:     true,
+			method:     "get",
+			path:       "/wgclient/5",
+			header:     map[string]string{"sub": "5"},
+			wantStatus: http.StatusInternalServerError,
+			wantType:   "application/json",
+			wantBody:   "store down",
+		},
+		{
+			name:       "TestClientGetNotFound",
+			method:     "get",
+			path:       "/wgclient/5",
+			header:     map[string]string{"sub": "5"},
+			wantStatus: http.StatusNotFound,
+			wantType:   "application/json",
+			wantBody:   "wgclient:not_found",
+		},
+		{
+			name:       "TestServerCreateIPInUse",
+			setup:      []string{"1"},
+			method:     "post",
+			path:       "/wgserver",
+			header:     map[string]string{"sub": "ops", "scope": "wireguard:admin"},
+			body:       `{"id": "wg-1", "public_key": "` + pk + `", "endpoint": "34.93.47.5", "private_ip": "10.33.0.1", "cidrs": ["10.33.0.0/24"]}`,
+			wantStatus: http.StatusConflict,
+			wantType:   "application/json",
+			wantBody:   "10.33.0.1 already in use",
+		},
+		{
+			name:       "TestServerCreateInvalid",
+			method:     "post",
+			path:       "/wgserver",
+			header:     map[string]string{"sub": "ops", "scope": "wireguard:admin"},
+			body:       `{"id": "wg-1", "public_key": "` + pk + `"}`,
+			wantStatus: http.StatusBadRequest,
+			wantType:   "application/json",
+			wantBody:   "endpoint:required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := tt.pool
+			if pool == "" {
+				pool = "10.33.0.0/24"
+			}
+			h := newHandler(t, pool, tt.broken)
+
+			for _, id := range tt.setup {
+				w := serve(h, "post", "/wgclient", map[string]string{"sub": id}, `{}`)
+				if w.Code != http.StatusOK {
+					t.Fatalf("setup %s status = %d, body %s", id, w.Code, w.Body)
+				}
+			}
+
+			w := serve(h, tt.method, tt.path, tt.header, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.wantType)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want %q", w.Body, tt.wantBody)
+			}
+
+			if tt.wantForbidden != nil {
+				var got struct {
+					Error     string               `json:"error"`
+					Forbidden *auth.ForbiddenError `json:"forbidden"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got.Forbidden, tt.wantForbidden) || got.Error != tt.wantForbidden.Error() {
+					t.Errorf("forbidden = %+v, %q, want %+v", got.Forbidden, got.Error, tt.wantForbidden)
+				}
+			}
+		})
+	}
+}
+
+func serve(h http.Handler, method, path string, header map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(strings.ToUpper(method), path, strings.NewReader(body)).WithContext(context.Background())
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,363 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/internal/contextutils"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrAPIKeyNotFound is returned for unknown api key.
+	ErrAPIKeyNotFound = errors.New("api key not found")
+
+	// ErrAPIKeyInvalid means api key is malformed, unknown, expired or its secret does not match.
+	ErrAPIKeyInvalid = errors.New("invalid api key")
+)
+
+func init() {
+	gob.Register(&APIKey{})
+}
+
+// apiKeyPrefix of keys, so that leaked keys are easy to spot.
+const apiKeyPrefix = "wgk_"
+
+// APIKeyStore is store of api keys, e.g. cache.Store.
+type APIKeyStore interface {
+	Get(context.Context, string) (interface{}, error)
+	Set(context.Context, string, interface{}, ...int) error
+	Delete(context.Context, string) (interface{}, error)
+	Keys(context.Context, string) ([]string, error)
+}
+
+// APIKey of a service, its secret is only stored as salted hash.
+// Key is set only when it is created, Salt and Hash only in store.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Subject   string     `json:"sub"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Key       string     `json:"key,omitempty"`
+	Salt      string     `json:"salt,omitempty"`
+	Hash      string     `json:"hash,omitempty"`
+}
+
+// Expired tells if key has expiry and it is over at now.
+func (k *APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// Claims of key, as JWT.HTTPMiddleware would put them in context for a token.
+func (k *APIKey) Claims() map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub":   k.Subject,
+		"jti":   k.ID,
+		"scope": strings.Join(k.Scopes, " "),
+		"iat":   k.CreatedAt.Unix(),
+	}
+	if k.ExpiresAt != nil {
+		claims["exp"] = k.ExpiresAt.Unix()
+	}
+	return claims
+}
+
+// public copy of key without salt and hash.
+func (k *APIKey) public() *APIKey {
+	c := *k
+	c.Salt, c.Hash = "", ""
+	return &c
+}
+
+// CreateAPIKeyInput of a new key, sub defaults to apikey:<id>, only callers with
+// client:write may set another. TTL in seconds or ExpiresAt make key expire.
+type CreateAPIKeyInput struct {
+	Name      string     `json:"name,omitempty"`
+	Subject   string     `json:"sub,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	TTL       int        `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// expiresAt of key of input at now, nil if it does not expire.
+func (in *CreateAPIKeyInput) expiresAt(now time.Time) (*time.Time, error) {
+	switch {
+	case in.TTL != 0 && in.ExpiresAt != nil:
+		return nil, fmt.Errorf("expiry:either ttl or expires_at")
+	case in.TTL < 0:
+		return nil, fmt.Errorf("expiry:ttl %d is negative", in.TTL)
+	case in.TTL > 0:
+		at := now.Add(time.Duration(in.TTL) * time.Second).UTC()
+		return &at, nil
+	case in.ExpiresAt != nil:
+		if !now.Before(*in.ExpiresAt) {
+			return nil, fmt.Errorf("expiry:expires_at %s is over", in.ExpiresAt.Format(time.RFC3339))
+		}
+		at := in.ExpiresAt.UTC()
+		return &at, nil
+	}
+	return nil, nil
+}
+
+// APIKeys auth of services by keys kept in store, keys are wgk_<id>.<secret>
+// and sent in X-API-Key header.
+type APIKeys struct {
+	store       APIKeyStore
+	policy      *Policy
+	headerKey   string
+	fallback    func(http.Handler) http.Handler
+	revocations RevocationList
+	errHandler  ErrorHandler
+}
+
+// NewAPIKeys is constructor of APIKeys of store, policy maps scopes of keys to permissions.
+func NewAPIKeys(store APIKeyStore, policy *Policy) *APIKeys {
+	return &APIKeys{
+		store:     store,
+		policy:    policy,
+		headerKey: "X-API-Key",
+		errHandler: func(err error) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeError(err, http.StatusUnauthorized, w)
+			})
+		},
+	}
+}
+
+// SetHeaderKey set the header key which will contain the api key.
+func (a *APIKeys) SetHeaderKey(k string) {
+	a.headerKey = k
+}
+
+// SetErrHandler set the error handler used when api key auth fail.
+func (a *APIKeys) SetErrHandler(h ErrorHandler) {
+	a.errHandler = h
+}
+
+// SetFallback sets auth of requests without api key, e.g. JWT.HTTPMiddleware.
+// Such requests are rejected when it is not set.
+func (a *APIKeys) SetFallback(m func(http.Handler) http.Handler) {
+	a.fallback = m
+}
+
+// SetRevocationList sets list of revoked tokens, keys are rejected when their id, as jti,
+// or their subject is revoked, like tokens of JWT.HTTPMiddleware.
+func (a *APIKeys) SetRevocationList(l RevocationList) {
+	a.revocations = l
+}
+
+// Create key of input for caller, returned key has its secret Key, it can not be read again.
+// Returns *ForbiddenError if scopes of key grant a permission caller lacks, or if
+// caller without client:write sets sub, so that keys can not escalate or impersonate.
+func (a *APIKeys) Create(ctx context.Context, caller *Caller, in *CreateAPIKeyInput) (*APIKey, error) {
+	if in.Subject != "" && !caller.Can(PermClientWrite) {
+		return nil, &ForbiddenError{Subject: caller.Subject, Permission: PermClientWrite, Resource: "apikey:sub:" + in.Subject}
+	}
+	granted := a.policy.Caller(map[string]interface{}{"scope": in.Scopes})
+	for _, p := range AllPermissions {
+		if granted.Can(p) && !caller.Can(p) {
+			return nil, &ForbiddenError{Subject: caller.Subject, Permission: p, Resource: "apikey:scopes"}
+		}
+	}
+
+	now := time.Now()
+	expiresAt, err := in.expiresAt(now)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := randomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      in.Name,
+		Subject:   in.Subject,
+		Scopes:    in.Scopes,
+		CreatedAt: now.UTC(),
+		ExpiresAt: expiresAt,
+		Salt:      hex.EncodeToString(salt),
+	}
+	if k.Subject == "" {
+		k.Subject = "apikey:" + k.ID
+	}
+	s := base64.RawURLEncoding.EncodeToString(secret)
+	k.Hash = hashAPIKey(k.Salt, s)
+
+	if err := a.store.Set(ctx, a.key(k.ID), k); err != nil {
+		return nil, fmt.Errorf("store:set:%v", err)
+	}
+
+	out := k.public()
+	out.Key = apiKeyPrefix + k.ID + "." + s
+	return out, nil
+}
+
+// List keys by creation, without their secrets.
+func (a *APIKeys) List(ctx context.Context) ([]*APIKey, error) {
+	keys, err := a.store.Keys(ctx, a.key(""))
+	if err != nil {
+		return nil, fmt.Errorf("store:keys:%v", err)
+	}
+
+	out := []*APIKey{}
+	for _, sk := range keys {
+		k, err := a.get(ctx, sk)
+		if err != nil {
+			return nil, err
+		}
+		if k != nil {
+			out = append(out, k.public())
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+// Revoke key of id, it is deleted.
+func (a *APIKeys) Revoke(ctx context.Context, id string) (*APIKey, error) {
+	k, err := a.get(ctx, a.key(id))
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	if _, err := a.store.Delete(ctx, a.key(id)); err != nil {
+		return nil, fmt.Errorf("store:delete:%v", err)
+	}
+	return k.public(), nil
+}
+
+// Verify key and return its claims, ErrTokenRevoked if its id or subject is revoked.
+func (a *APIKeys) Verify(ctx context.Context, key string) (map[string]interface{}, error) {
+	id, secret, ok := parseAPIKey(key)
+	if !ok {
+		return nil, errors.Wrap(ErrAPIKeyInvalid, "apikeys.Verify:malformed")
+	}
+
+	k, err := a.get(ctx, a.key(id))
+	if err != nil {
+		return nil, errors.Wrap(err, "apikeys.Verify")
+	}
+	if k == nil {
+		return nil, errors.Wrap(ErrAPIKeyInvalid, "apikeys.Verify:unknown")
+	}
+
+	// compare hashes in constant time, so that secret can not be guessed by timing.
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(k.Salt, secret)), []byte(k.Hash)) != 1 {
+		return nil, errors.Wrap(ErrAPIKeyInvalid, "apikeys.Verify:secret")
+	}
+	if k.Expired(time.Now()) {
+		return nil, errors.Wrap(ErrAPIKeyInvalid, "apikeys.Verify:expired")
+	}
+
+	claims := k.Claims()
+	if a.revocations != nil {
+		// keys are rejected as well when revocation list can not be read.
+		revoked, err := a.revocations.Revoked(ctx, claims)
+		if err != nil {
+			return nil, errors.Wrap(err, "apikeys.Verify")
+		}
+		if revoked {
+			return nil, errors.Wrap(ErrTokenRevoked, "apikeys.Verify")
+		}
+	}
+	return claims, nil
+}
+
+// HTTPMiddleware wraps a http.Handler to perform api key auth on request,
+// claims are put in context like JWT.HTTPMiddleware does.
+func (a *APIKeys) HTTPMiddleware(next http.Handler) http.Handler {
+	var fallback http.Handler
+	if a.fallback != nil {
+		fallback = a.fallback(next)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(a.headerKey)
+		if key == "" && fallback != nil {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := a.Verify(r.Context(), key)
+		if err != nil {
+			a.errHandler(err).ServeHTTP(w, r)
+			return
+		}
+
+		ctx := contextutils.Set(r.Context(), contextutils.Params, claims)
+		r = r.WithContext(ctx)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *APIKeys) get(ctx context.Context, key string) (*APIKey, error) {
+	v, err := a.store.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("store:get:%v", err)
+	}
+	k, _ := v.(*APIKey)
+	return k, nil
+}
+
+func (a *APIKeys) key(id string) string {
+	return fmt.Sprintf("apikey:%s", id)
+}
+
+// parseAPIKey of form wgk_<id>.<secret>.
+func parseAPIKey(key string) (id, secret string, ok bool) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// hashAPIKey is hex of sha256 of salt and secret, secrets are random so a slow hash is not needed.
+func hashAPIKey(salt, secret string) string {
+	h := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(h[:])
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
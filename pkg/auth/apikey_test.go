@@ -0,0 +1,215 @@
+package auth_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/internal/contextutils"
+	"bitbucket.org/qubole/wireguard/pkg/auth"
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+	"github.com/pkg/errors"
+)
+
+func TestAPIKeys_Verify(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewMap()
+	p := auth.NewPolicy()
+	admin := p.Caller(map[string]interface{}{"sub": "alice", "scope": "wireguard:admin"})
+	a := auth.NewAPIKeys(store, p)
+
+	ci, err := a.Create(ctx, admin, &auth.CreateAPIKeyInput{Name: "ci", Subject: "ci-runner", Scopes: []string{"wireguard:client:write"}})
+	if err != nil {
+		t.Fatalf("APIKeys.Create() error = %v", err)
+	}
+	short, err := a.Create(ctx, admin, &auth.CreateAPIKeyInput{TTL: 1})
+	if err != nil {
+		t.Fatalf("APIKeys.Create() error = %v", err)
+	}
+	revoked, _ := a.Create(ctx, admin, &auth.CreateAPIKeyInput{})
+	if _, err := a.Revoke(ctx, revoked.ID); err != nil {
+		t.Fatalf("APIKeys.Revoke() error = %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	// only salted hash is stored.
+	v, _ := store.Get(ctx, "apikey:"+ci.ID)
+	if stored := v.(*auth.APIKey); stored.Key != "" || stored.Hash == "" || strings.Contains(ci.Key, stored.Hash) {
+		t.Errorf("APIKeys.Create() stored %+v, want hash only", stored)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		wantSub string
+		wantErr bool
+	}{
+		{name: "TestAPIKeyValid", key: ci.Key, wantSub: "ci-runner"},
+		{name: "TestAPIKeyWrongSecret", key: ci.Key[:len(ci.Key)-2] + "xx", wantErr: true},
+		{name: "TestAPIKeyMalformed", key: "ci-runner", wantErr: true},
+		{name: "TestAPIKeyExpired", key: short.Key, wantErr: true},
+		{name: "TestAPIKeyRevoked", key: revoked.Key, wantErr: true},
+		{name: "TestAPIKeyEmpty", key: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := a.Verify(ctx, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("APIKeys.Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if errors.Cause(err) != auth.ErrAPIKeyInvalid {
+					t.Errorf("APIKeys.Verify() error = %v, want %v", err, auth.ErrAPIKeyInvalid)
+				}
+				return
+			}
+			if claims["sub"] != tt.wantSub || claims["scope"] != "wireguard:client:write" {
+				t.Errorf("APIKeys.Verify() claims = %v, want sub %s", claims, tt.wantSub)
+			}
+		})
+	}
+
+	keys, err := a.List(ctx)
+	if err != nil {
+		t.Fatalf("APIKeys.List() error = %v", err)
+	}
+	if len(keys) != 2 || keys[0].ID != ci.ID || keys[1].Subject != "apikey:"+short.ID {
+		t.Errorf("APIKeys.List() = %+v, want ci and short keys", keys)
+	}
+	for _, k := range keys {
+		if k.Key != "" || k.Hash != "" || k.Salt != "" {
+			t.Errorf("APIKeys.List() key %s has secret", k.ID)
+		}
+	}
+
+	if _, err := a.Revoke(ctx, revoked.ID); err != auth.ErrAPIKeyNotFound {
+		t.Errorf("APIKeys.Revoke() error = %v, want %v", err, auth.ErrAPIKeyNotFound)
+	}
+	if _, err := a.Create(ctx, admin, &auth.CreateAPIKeyInput{TTL: -1}); err == nil {
+		t.Errorf("APIKeys.Create() negative ttl error = nil")
+	}
+}
+
+func TestAPIKeys_HTTPMiddleware(t *testing.T) {
+	ctx := context.Background()
+
+	j := auth.NewJWT("my_test_key")
+	token, _ := j.Generate(map[string]interface{}{"sub": "jwt-runner"})
+
+	p := auth.NewPolicy()
+	admin := p.Caller(map[string]interface{}{"sub": "alice", "scope": "wireguard:admin"})
+	store := cache.NewMap()
+	a := auth.NewAPIKeys(store, p)
+	a.SetFallback(j.HTTPMiddleware)
+	k, _ := a.Create(ctx, admin, &auth.CreateAPIKeyInput{Subject: "ci-runner", Scopes: []string{"wireguard:admin"}})
+
+	// keys of a revoked subject, or revoked by id, are rejected like tokens.
+	revocations := auth.NewRevocations(store)
+	a.SetRevocationList(revocations)
+	bySub, _ := a.Create(ctx, admin, &auth.CreateAPIKeyInput{Subject: "ops-bot"})
+	byID, _ := a.Create(ctx, admin, &auth.CreateAPIKeyInput{Subject: "deploy-bot"})
+	if _, err := revocations.Revoke(ctx, "", "ops-bot", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := revocations.Revoke(ctx, byID.ID, "", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	reissued, _ := a.Create(ctx, admin, &auth.CreateAPIKeyInput{Subject: "ops-bot"})
+
+	h := a.HTTPMiddleware(p.HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sub":   contextutils.Get(r.Context(), contextutils.Params)["sub"],
+			"admin": auth.CallerFrom(r.Context()).Can(auth.PermServerAdmin),
+		})
+	})))
+
+	tests := []struct {
+		name       string
+		header     map[string]string
+		wantSub    string
+		wantAdmin  bool
+		wantStatus int
+	}{
+		{name: "TestAPIKey", header: map[string]string{"X-API-Key": k.Key}, wantSub: "ci-runner", wantAdmin: true, wantStatus: http.StatusOK},
+		{name: "TestAPIKeyRevokedSubject", header: map[string]string{"X-API-Key": bySub.Key}, wantStatus: http.StatusUnauthorized},
+		{name: "TestAPIKeyRevokedID", header: map[string]string{"X-API-Key": byID.Key}, wantStatus: http.StatusUnauthorized},
+		{name: "TestAPIKeyIssuedAfterRevocation", header: map[string]string{"X-API-Key": reissued.Key}, wantSub: "ops-bot", wantStatus: http.StatusOK},
+		{name: "TestAPIKeyInvalid", header: map[string]string{"X-API-Key": k.Key + "x", "Authorization": "Bearer " + token}, wantStatus: http.StatusUnauthorized},
+		{name: "TestFallbackJWT", header: map[string]string{"Authorization": "Bearer " + token}, wantSub: "jwt-runner", wantStatus: http.StatusOK},
+		{name: "TestNoCredentials", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/wgclient", nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("APIKeys.HTTPMiddleware() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got map[string]interface{}
+			json.NewDecoder(w.Body).Decode(&got)
+			if got["sub"] != tt.wantSub || got["admin"] != tt.wantAdmin {
+				t.Errorf("APIKeys.HTTPMiddleware() = %v, want sub %s admin %v", got, tt.wantSub, tt.wantAdmin)
+			}
+		})
+	}
+}
+
+func TestAPIKeys_CreateForbidden(t *testing.T) {
+	ctx := context.Background()
+	p := auth.NewPolicy()
+	a := auth.NewAPIKeys(cache.NewMap(), p)
+
+	// token admin, e.g. granted by -default-permissions or a group, but no client or server admin.
+	tokenAdmin := &auth.Caller{Subject: "bob", Permissions: map[auth.Permission]bool{
+		auth.PermClientOwn:  true,
+		auth.PermTokenAdmin: true,
+	}}
+	writer := p.Caller(map[string]interface{}{"sub": "carol", "scope": "wireguard:client:write"})
+
+	tests := []struct {
+		name     string
+		caller   *auth.Caller
+		in       *auth.CreateAPIKeyInput
+		wantPerm auth.Permission
+	}{
+		{name: "TestEscalateAdminScope", caller: tokenAdmin, in: &auth.CreateAPIKeyInput{Scopes: []string{"wireguard:admin"}}, wantPerm: auth.PermClientRead},
+		{name: "TestEscalateWriteScope", caller: tokenAdmin, in: &auth.CreateAPIKeyInput{Scopes: []string{"wireguard:client:write"}}, wantPerm: auth.PermClientRead},
+		{name: "TestImpersonate", caller: tokenAdmin, in: &auth.CreateAPIKeyInput{Subject: "alice"}, wantPerm: auth.PermClientWrite},
+		{name: "TestWriterEscalateAdminScope", caller: writer, in: &auth.CreateAPIKeyInput{Scopes: []string{"wireguard:admin"}}, wantPerm: auth.PermServerAdmin},
+		{name: "TestOwnScope", caller: tokenAdmin, in: &auth.CreateAPIKeyInput{Scopes: []string{"wireguard:client"}}},
+		{name: "TestWriterSubject", caller: writer, in: &auth.CreateAPIKeyInput{Subject: "alice", Scopes: []string{"wireguard:client:read"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := a.Create(ctx, tt.caller, tt.in)
+			if tt.wantPerm == "" {
+				if err != nil {
+					t.Errorf("APIKeys.Create() error = %v", err)
+				}
+				return
+			}
+
+			fe, ok := err.(*auth.ForbiddenError)
+			if !ok {
+				t.Fatalf("APIKeys.Create() = %+v, %v, want *auth.ForbiddenError", k, err)
+			}
+			if fe.Permission != tt.wantPerm {
+				t.Errorf("APIKeys.Create() lacks %s, want %s", fe.Permission, tt.wantPerm)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+
+	"bitbucket.org/qubole/wireguard/internal/contextutils"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrClientCertNotFound means request has no client certificate verified by tls server.
+	ErrClientCertNotFound = errors.New("verified client certificate not found")
+
+	// ErrClientCertNoIdentity means client certificate has neither a SAN nor a CN.
+	ErrClientCertNoIdentity = errors.New("client certificate has no identity")
+)
+
+// ClientCert auth of callers by tls client certificates, verified against client CAs by the server.
+// Caller identity is the first DNS, URI or email SAN of certificate, else its CN.
+// Organizational units grant no groups unless they are mapped by SetGroups.
+type ClientCert struct {
+	fallback   func(http.Handler) http.Handler
+	errHandler ErrorHandler
+	groups     map[string]string
+}
+
+// NewClientCert is constructor of ClientCert.
+func NewClientCert() *ClientCert {
+	return &ClientCert{
+		errHandler: func(err error) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeError(err, http.StatusUnauthorized, w)
+			})
+		},
+	}
+}
+
+// SetErrHandler set the error handler used when client certificate auth fail.
+func (c *ClientCert) SetErrHandler(h ErrorHandler) {
+	c.errHandler = h
+}
+
+// SetFallback sets auth of requests without client certificate, e.g. JWT.HTTPMiddleware.
+// Such requests are rejected when it is not set.
+func (c *ClientCert) SetFallback(m func(http.Handler) http.Handler) {
+	c.fallback = m
+}
+
+// SetGroups maps organizational units of certificates to groups claim values, e.g. of Policy.GrantGroup.
+// OUs are chosen by whoever the CA issues to, so they are not groups as is.
+func (c *ClientCert) SetGroups(groups map[string]string) {
+	c.groups = groups
+}
+
+// Claims of certificate, sub is identity and groups are its mapped organizational units.
+func (c *ClientCert) Claims(cert *x509.Certificate) (map[string]interface{}, error) {
+	var sub string
+	switch {
+	case len(cert.DNSNames) > 0:
+		sub = cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		sub = cert.URIs[0].String()
+	case len(cert.EmailAddresses) > 0:
+		sub = cert.EmailAddresses[0]
+	default:
+		sub = cert.Subject.CommonName
+	}
+	if sub == "" {
+		return nil, errors.Wrap(ErrClientCertNoIdentity, "clientcert.Claims")
+	}
+
+	groups := []interface{}{}
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if g, ok := c.groups[ou]; ok {
+			groups = append(groups, g)
+		}
+	}
+
+	return map[string]interface{}{
+		"sub":    sub,
+		"groups": groups,
+		"iss":    cert.Issuer.CommonName,
+		"exp":    cert.NotAfter.Unix(),
+	}, nil
+}
+
+// HTTPMiddleware wraps a http.Handler to perform client certificate auth on request,
+// claims are put in context like JWT.HTTPMiddleware does.
+func (c *ClientCert) HTTPMiddleware(next http.Handler) http.Handler {
+	var fallback http.Handler
+	if c.fallback != nil {
+		fallback = c.fallback(next)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// chains are only set when server verified certificate with client CAs.
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			if fallback != nil {
+				fallback.ServeHTTP(w, r)
+				return
+			}
+			c.errHandler(errors.Wrap(ErrClientCertNotFound, "clientcert.HTTPMiddleware")).ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := c.Claims(r.TLS.VerifiedChains[0][0])
+		if err != nil {
+			c.errHandler(err).ServeHTTP(w, r)
+			return
+		}
+
+		ctx := contextutils.Set(r.Context(), contextutils.Params, claims)
+		r = r.WithContext(ctx)
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,185 @@
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/internal/contextutils"
+	"bitbucket.org/qubole/wireguard/pkg/auth"
+)
+
+func TestClientCert_HTTPMiddleware(t *testing.T) {
+	ca, caKey := newCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "agents-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	other, otherKey := newCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "other-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	j := auth.NewJWT("my_test_key")
+	jwtToken, _ := j.Generate(map[string]interface{}{"sub": "jwt-runner"})
+
+	cc := auth.NewClientCert()
+	cc.SetFallback(j.HTTPMiddleware)
+	cc.SetGroups(map[string]string{"agents": "wg-agents"})
+
+	h := cc.HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(contextutils.Get(r.Context(), contextutils.Params))
+	}))
+	ts := httptest.NewUnstartedServer(h)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ts.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		template   *x509.Certificate
+		issuer     *x509.Certificate
+		issuerKey  *ecdsa.PrivateKey
+		token      string
+		wantSub    string
+		wantGroups []interface{}
+		wantStatus int
+	}{
+		{
+			name: "TestClientCertDNSName",
+			template: &x509.Certificate{
+				Subject:  pkix.Name{CommonName: "agent-1", OrganizationalUnit: []string{"agents"}},
+				DNSNames: []string{"agent-1.example.com"},
+			},
+			issuer: ca, issuerKey: caKey,
+			wantSub: "agent-1.example.com", wantGroups: []interface{}{"wg-agents"}, wantStatus: http.StatusOK,
+		},
+		{
+			name: "TestClientCertUnmappedOU",
+			template: &x509.Certificate{
+				Subject: pkix.Name{CommonName: "agent-3", OrganizationalUnit: []string{"admins"}},
+			},
+			issuer: ca, issuerKey: caKey,
+			wantSub: "agent-3", wantGroups: []interface{}{}, wantStatus: http.StatusOK,
+		},
+		{
+			name:     "TestClientCertCommonName",
+			template: &x509.Certificate{Subject: pkix.Name{CommonName: "agent-2"}},
+			issuer:   ca, issuerKey: caKey,
+			wantSub: "agent-2", wantGroups: []interface{}{}, wantStatus: http.StatusOK,
+		},
+		{
+			name:       "TestClientCertNoIdentity",
+			template:   &x509.Certificate{},
+			issuer:     ca,
+			issuerKey:  caKey,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:    "TestFallbackJWT",
+			token:   jwtToken,
+			wantSub: "jwt-runner", wantStatus: http.StatusOK,
+		},
+		{
+			name:       "TestFallbackNoToken",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &tls.Config{RootCAs: x509.NewCertPool()}
+			cfg.RootCAs.AddCert(ts.Certificate())
+			if tt.template != nil {
+				tt.template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+				cert, key := newCert(t, tt.template, tt.issuer, tt.issuerKey)
+				cfg.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+
+			req, _ := http.NewRequest("GET", ts.URL, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("ClientCert.HTTPMiddleware() status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var claims map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&claims)
+			if claims["sub"] != tt.wantSub {
+				t.Errorf("ClientCert.HTTPMiddleware() sub = %v, want %s", claims["sub"], tt.wantSub)
+			}
+			if tt.wantGroups != nil && !reflect.DeepEqual(claims["groups"], tt.wantGroups) {
+				t.Errorf("ClientCert.HTTPMiddleware() groups = %v, want %v", claims["groups"], tt.wantGroups)
+			}
+		})
+	}
+
+	// certificate of other CA fails tls handshake.
+	cert, key := newCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "intruder"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, other, otherKey)
+	cfg := &tls.Config{
+		RootCAs: x509.NewCertPool(),
+		// sent although server does not accept its CA.
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}, nil
+		},
+	}
+	cfg.RootCAs.AddCert(ts.Certificate())
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	if resp, err := client.Get(ts.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("ClientCert.HTTPMiddleware() certificate of other CA status = %d, want tls error", resp.StatusCode)
+	}
+}
+
+// newCert signs template with issuer, self-signed when issuer is nil.
+func newCert(t *testing.T, template, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if issuer == nil {
+		issuer, issuerKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
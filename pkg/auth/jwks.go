@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/internal/httpclient"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrKeyNotFound means key source has no key of kid.
+	ErrKeyNotFound = errors.New("jwt key id not found")
+)
+
+// KeySource returns public key of kid, e.g. of keys published by identity provider.
+type KeySource interface {
+	Key(kid string) (interface{}, error)
+}
+
+// JWKS is KeySource of a JSON Web Key Set url.
+// Keys are cached and fetched again once max age is over, or on an unknown kid
+// but at most once every min refresh interval. Keys dropped from the set are
+// still accepted for grace period, so tokens signed before rotation stay valid.
+// Only one fetch is in flight at a time and cached keys are returned without waiting for it.
+type JWKS struct {
+	url string
+
+	minRefresh time.Duration
+	maxAge     time.Duration
+	grace      time.Duration
+	timeout    time.Duration
+
+	mu         sync.Mutex
+	keys       map[string]*jwk
+	fetchedAt  time.Time     // last successful fetch
+	triedAt    time.Time     // last fetch
+	fetchErr   error         // error of last fetch
+	refreshing chan struct{} // closed once fetch in flight is done, nil if none
+}
+
+type jwk struct {
+	key       interface{}
+	retiredAt time.Time // zero while key is in set
+}
+
+// jwkJSON is a key of JWKS document, RFC 7517 and RFC 8037 for OKP.
+type jwkJSON struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewJWKS is constructor of JWKS of url.
+func NewJWKS(url string) *JWKS {
+	return &JWKS{
+		url:        url,
+		minRefresh: 30 * time.Second,
+		maxAge:     time.Hour,
+		grace:      time.Hour,
+		timeout:    10 * time.Second,
+		keys:       map[string]*jwk{},
+	}
+}
+
+// SetMinRefreshInterval sets min time between fetches of set.
+func (s *JWKS) SetMinRefreshInterval(d time.Duration) {
+	s.minRefresh = d
+}
+
+// SetMaxAge sets how long fetched set is used before it is fetched again.
+func (s *JWKS) SetMaxAge(d time.Duration) {
+	s.maxAge = d
+}
+
+// SetGracePeriod sets how long keys dropped from set are still accepted.
+func (s *JWKS) SetGracePeriod(d time.Duration) {
+	s.grace = d
+}
+
+// Key returns public key of kid.
+func (s *JWKS) Key(kid string) (interface{}, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	_, ok := s.keys[kid]
+	stale := now.Sub(s.fetchedAt) >= s.maxAge
+
+	done := s.refreshing
+	if (!ok || stale) && now.Sub(s.triedAt) >= s.minRefresh {
+		done = s.refresh(now)
+	}
+	s.mu.Unlock()
+
+	// cached keys never wait on the network, unknown kids wait for fetch in flight.
+	if !ok && done != nil {
+		<-done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[kid]
+	if !ok {
+		if done != nil && s.fetchErr != nil {
+			return nil, s.fetchErr
+		}
+		return nil, errors.Wrapf(ErrKeyNotFound, "kid %q", kid)
+	}
+	if !k.retiredAt.IsZero() && now.Sub(k.retiredAt) >= s.grace {
+		return nil, errors.Wrapf(ErrKeyNotFound, "kid %q is retired", kid)
+	}
+	return k.key, nil
+}
+
+// refresh starts fetch of set unless one is in flight and returns channel closed once it is done,
+// mutex must be held.
+func (s *JWKS) refresh(now time.Time) chan struct{} {
+	if s.refreshing != nil {
+		return s.refreshing
+	}
+
+	s.triedAt = now
+	done := make(chan struct{})
+	s.refreshing = done
+
+	go func() {
+		defer close(done)
+
+		keys, err := s.fetch()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.refreshing = nil
+		s.fetchErr = err
+		if err == nil {
+			s.merge(keys, time.Now())
+		}
+	}()
+	return done
+}
+
+// fetch set, mutex must not be held as it waits on the network.
+func (s *JWKS) fetch() (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	status, body, err := httpclient.Get(ctx, s.url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "jwks.fetch")
+	}
+	if status != http.StatusOK {
+		return nil, errors.Errorf("jwks.fetch:status %d", status)
+	}
+
+	var doc struct {
+		Keys []jwkJSON `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, errors.Wrap(err, "jwks.fetch")
+	}
+
+	fetched := map[string]interface{}{}
+	for _, kj := range doc.Keys {
+		if kj.Use != "" && kj.Use != "sig" {
+			continue
+		}
+		key, err := kj.publicKey()
+		if err != nil {
+			// a key of unsupported type must not fail others.
+			continue
+		}
+		fetched[kj.Kid] = key
+	}
+	return fetched, nil
+}
+
+// merge fetched keys into keys, retiring keys dropped from set, mutex must be held.
+func (s *JWKS) merge(fetched map[string]interface{}, now time.Time) {
+	for kid, k := range s.keys {
+		if _, ok := fetched[kid]; ok {
+			continue
+		}
+		if k.retiredAt.IsZero() {
+			k.retiredAt = now
+		}
+		if now.Sub(k.retiredAt) >= s.grace {
+			delete(s.keys, kid)
+		}
+	}
+	for kid, key := range fetched {
+		s.keys[kid] = &jwk{key: key}
+	}
+
+	s.fetchedAt = now
+}
+
+func (k *jwkJSON) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("jwk:crv %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("jwk:point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.Errorf("jwk:crv %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("jwk:invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.Errorf("jwk:kty %s", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
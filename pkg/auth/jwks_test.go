@@ -0,0 +1,228 @@
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/pkg/auth"
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// jwksServer serves a JWKS document of its keys after delay and counts fetches.
+type jwksServer struct {
+	sync.Mutex
+	keys    []map[string]string
+	fetches int
+	delay   time.Duration
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.fetches++
+	keys, delay := s.keys, s.delay
+	s.Unlock()
+
+	time.Sleep(delay)
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (s *jwksServer) setDelay(d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.delay = d
+}
+
+func (s *jwksServer) set(keys ...map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+	s.keys = keys
+}
+
+func (s *jwksServer) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.fetches
+}
+
+func TestJWKS_VerifyToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &jwksServer{}
+	srv.set(
+		map[string]string{"kid": "rsa", "kty": "RSA", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		map[string]string{"kid": "ec", "kty": "EC", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		map[string]string{"kid": "ed", "kty": "OKP", "crv": "Ed25519", "x": b64(edPub)},
+		map[string]string{"kid": "enc", "kty": "RSA", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+	)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	j := auth.NewJWT("")
+	j.SetAlgorithms("RS256", "ES256", "EdDSA")
+	j.SetKeySource(auth.NewJWKS(ts.URL))
+
+	tests := []struct {
+		name      string
+		kid       string
+		method    jwtgo.SigningMethod
+		signKey   interface{}
+		wantCause error
+	}{
+		{name: "TestJWKSRSA", kid: "rsa", method: jwtgo.SigningMethodRS256, signKey: rsaKey},
+		{name: "TestJWKSEC", kid: "ec", method: jwtgo.SigningMethodES256, signKey: ecKey},
+		{name: "TestJWKSEd25519", kid: "ed", method: auth.SigningMethodEdDSA, signKey: edKey},
+		{name: "TestJWKSWrongKey", kid: "rsa", method: jwtgo.SigningMethodES256, signKey: ecKey, wantCause: auth.ErrKeyInvalid},
+		{name: "TestJWKSEncryptionKey", kid: "enc", method: jwtgo.SigningMethodRS256, signKey: rsaKey, wantCause: auth.ErrKeyNotFound},
+		{name: "TestJWKSUnknownKid", kid: "other", method: jwtgo.SigningMethodRS256, signKey: rsaKey, wantCause: auth.ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := signToken(t, tt.method, tt.kid, tt.signKey)
+
+			_, err := j.VerifyToken(token)
+			if errors.Cause(err) != tt.wantCause {
+				t.Errorf("JWT.VerifyToken() error = %v, want %v", err, tt.wantCause)
+			}
+		})
+	}
+
+	// set was fetched once, unknown kids within min refresh interval do not fetch again.
+	if n := srv.count(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", n)
+	}
+}
+
+func TestJWKS_Rotation(t *testing.T) {
+	oldPub, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	newPub, newKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	srv := &jwksServer{}
+	srv.set(map[string]string{"kid": "old", "kty": "OKP", "crv": "Ed25519", "x": b64(oldPub)})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	jwks := auth.NewJWKS(ts.URL)
+	jwks.SetMinRefreshInterval(50 * time.Millisecond)
+	jwks.SetGracePeriod(200 * time.Millisecond)
+
+	j := auth.NewJWT("")
+	j.SetAlgorithms("EdDSA")
+	j.SetKeySource(jwks)
+
+	oldToken := signToken(t, auth.SigningMethodEdDSA, "old", oldKey)
+	newToken := signToken(t, auth.SigningMethodEdDSA, "new", newKey)
+
+	if _, err := j.VerifyToken(oldToken); err != nil {
+		t.Fatalf("JWT.VerifyToken() old key error = %v", err)
+	}
+
+	// identity provider rotates to new key.
+	srv.set(map[string]string{"kid": "new", "kty": "OKP", "crv": "Ed25519", "x": b64(newPub)})
+
+	// unknown kid is rate limited till min refresh interval is over.
+	if _, err := j.VerifyToken(newToken); errors.Cause(err) != auth.ErrKeyNotFound {
+		t.Errorf("JWT.VerifyToken() new key before refresh error = %v, want %v", err, auth.ErrKeyNotFound)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := j.VerifyToken(newToken); err != nil {
+		t.Errorf("JWT.VerifyToken() new key error = %v", err)
+	}
+	if n := srv.count(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+
+	// retired key is accepted during grace period only.
+	if _, err := j.VerifyToken(oldToken); err != nil {
+		t.Errorf("JWT.VerifyToken() retired key in grace period error = %v", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if _, err := j.VerifyToken(oldToken); errors.Cause(err) != auth.ErrKeyNotFound {
+		t.Errorf("JWT.VerifyToken() retired key after grace period error = %v, want %v", err, auth.ErrKeyNotFound)
+	}
+}
+
+func TestJWKS_SlowFetch(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+
+	srv := &jwksServer{}
+	srv.set(map[string]string{"kid": "cached", "kty": "OKP", "crv": "Ed25519", "x": b64(pub)})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	jwks := auth.NewJWKS(ts.URL)
+	jwks.SetMinRefreshInterval(10 * time.Millisecond)
+
+	j := auth.NewJWT("")
+	j.SetAlgorithms("EdDSA")
+	j.SetKeySource(jwks)
+
+	cached := signToken(t, auth.SigningMethodEdDSA, "cached", key)
+	if _, err := j.VerifyToken(cached); err != nil {
+		t.Fatalf("JWT.VerifyToken() error = %v", err)
+	}
+
+	// identity provider is slow, a token of unknown kid waits for it.
+	srv.setDelay(500 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	unknownToken := signToken(t, auth.SigningMethodEdDSA, "unknown", key)
+	unknown := make(chan error, 1)
+	go func() {
+		_, err := j.VerifyToken(unknownToken)
+		unknown <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// cached key does not wait for fetch in flight.
+	begin := time.Now()
+	if _, err := j.VerifyToken(cached); err != nil {
+		t.Errorf("JWT.VerifyToken() cached key error = %v", err)
+	}
+	if d := time.Since(begin); d > 100*time.Millisecond {
+		t.Errorf("JWT.VerifyToken() cached key took %s while fetch in flight", d)
+	}
+
+	if err := <-unknown; errors.Cause(err) != auth.ErrKeyNotFound {
+		t.Errorf("JWT.VerifyToken() unknown kid error = %v, want %v", err, auth.ErrKeyNotFound)
+	}
+	if n := srv.count(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+}
+
+func signToken(t *testing.T, method jwtgo.SigningMethod, kid string, key interface{}) string {
+	token := jwtgo.NewWithClaims(method, jwtgo.MapClaims{"sub": "ci-runner"})
+	token.Header["kid"] = kid
+
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
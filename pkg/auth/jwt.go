@@ -1,10 +1,18 @@
 package auth
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -25,6 +33,21 @@ var (
 
 	// ErrUserNotAllowed means user's access is blocked.
 	ErrUserNotAllowed = errors.New("user is not allowed")
+
+	// ErrTokenNoExpiry means token has no exp claim while tokens must expire.
+	ErrTokenNoExpiry = errors.New("jwt token has no expiry")
+
+	// ErrIssuerInvalid means iss claim is not the issuer of JWT.
+	ErrIssuerInvalid = errors.New("invalid jwt issuer")
+
+	// ErrAudienceInvalid means aud claim does not contain the audience of JWT.
+	ErrAudienceInvalid = errors.New("invalid jwt audience")
+
+	// ErrAlgorithmNotAllowed means token is signed with an algorithm not allowed by JWT.
+	ErrAlgorithmNotAllowed = errors.New("jwt algorithm not allowed")
+
+	// ErrKeyInvalid means JWT has no key of the algorithm of token.
+	ErrKeyInvalid = errors.New("invalid jwt key")
 )
 
 // ClaimVerifier verifies claims from persistent store like database.
@@ -36,16 +59,26 @@ type ErrorHandler func(err error) http.Handler
 // JWT auth struct.
 type JWT struct {
 	key           string
+	publicKey     interface{} // *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+	keySource     KeySource
+	algorithms    []string
 	queryTokenKey string
 	headerKey     string
 	verifier      ClaimVerifier
+	revocations   RevocationList
 	errHandler    ErrorHandler
+
+	// defaults of registered claims of generated tokens, also enforced by VerifyToken.
+	issuer   string
+	audience string
+	ttl      time.Duration
 }
 
 // NewJWT is constructor of JWT.
 func NewJWT(key string) *JWT {
 	return &JWT{
 		key:           key,
+		algorithms:    []string{jwtgo.SigningMethodHS256.Alg()},
 		queryTokenKey: "token",
 		headerKey:     "Authorization",
 		verifier: func(claims map[string]interface{}) error {
@@ -79,7 +112,80 @@ func (j *JWT) SetHeaderKey(k string) {
 	j.headerKey = k
 }
 
+// SetAlgorithms sets algorithms tokens may be signed with, HS256 by default.
+// HS* verify with key of NewJWT, RS*, PS*, ES* and EdDSA with public key.
+func (j *JWT) SetAlgorithms(algs ...string) {
+	j.algorithms = algs
+}
+
+// SetPublicKeyPEM sets RSA, ECDSA or Ed25519 public key of PEM to verify tokens
+// signed by an identity provider with.
+func (j *JWT) SetPublicKeyPEM(data []byte) error {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.Wrap(ErrKeyInvalid, "jwt.SetPublicKeyPEM:no pem block")
+	}
+
+	var (
+		key interface{}
+		err error
+	)
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return errors.Wrapf(ErrKeyInvalid, "jwt.SetPublicKeyPEM:pem block %s", block.Type)
+	}
+	if err != nil {
+		return errors.Wrap(err, "jwt.SetPublicKeyPEM")
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return errors.Wrapf(ErrKeyInvalid, "jwt.SetPublicKeyPEM:key type %T", key)
+	}
+	j.publicKey = key
+	return nil
+}
+
+// SetKeySource sets source of public keys by kid header of token, e.g. JWKS of identity provider.
+// Tokens without kid are verified with public key of SetPublicKeyPEM.
+func (j *JWT) SetKeySource(ks KeySource) {
+	j.keySource = ks
+}
+
+// SetRevocationList sets list of revoked tokens, HTTPMiddleware rejects them.
+func (j *JWT) SetRevocationList(l RevocationList) {
+	j.revocations = l
+}
+
+// SetIssuer sets iss claim of generated tokens, tokens of other issuers fail verification.
+func (j *JWT) SetIssuer(iss string) {
+	j.issuer = iss
+}
+
+// SetAudience sets aud claim of generated tokens, tokens not meant for it fail verification.
+func (j *JWT) SetAudience(aud string) {
+	j.audience = aud
+}
+
+// SetTTL sets lifetime of generated tokens, tokens without exp fail verification when set.
+func (j *JWT) SetTTL(d time.Duration) {
+	j.ttl = d
+}
+
 // Generate jwt token based claims passed.
+// Registered claims iat, nbf and exp, iss, aud are set from defaults of JWT unless claims has them,
+// sub is only taken from claims. A random jti is set, so that token can be revoked.
 func (j *JWT) Generate(claims map[string]interface{}) (string, error) {
 	if j.key == "" {
 		return "", errors.Wrap(ErrJWTKeyNotFound, "jwt.Generate")
@@ -88,8 +194,29 @@ func (j *JWT) Generate(claims map[string]interface{}) (string, error) {
 	token := jwtgo.New(jwtgo.SigningMethodHS256)
 
 	newclaims := token.Claims.(jwtgo.MapClaims)
+	for k, v := range claims {
+		newclaims[k] = v
+	}
+
+	jti, err := randomID()
+	if err != nil {
+		return "", errors.Wrap(err, "jwt.Generate")
+	}
 
+	now := time.Now()
+	setDefault(newclaims, "jti", jti)
 	newclaims["_ts"] = fmt.Sprint(timeutils.UnixTime())
+	setDefault(newclaims, "iat", now.Unix())
+	setDefault(newclaims, "nbf", now.Unix())
+	if j.ttl > 0 {
+		setDefault(newclaims, "exp", now.Add(j.ttl).Unix())
+	}
+	if j.issuer != "" {
+		setDefault(newclaims, "iss", j.issuer)
+	}
+	if j.audience != "" {
+		setDefault(newclaims, "aud", j.audience)
+	}
 
 	s, e := token.SignedString([]byte(j.key))
 	if e != nil {
@@ -100,9 +227,11 @@ func (j *JWT) Generate(claims map[string]interface{}) (string, error) {
 
 // VerifyToken verifies jwt tokens.
 func (j *JWT) VerifyToken(jwttoken string) (map[string]interface{}, error) {
-	token, err := jwtgo.Parse(jwttoken, func(token *jwtgo.Token) (interface{}, error) {
-		return []byte(j.key), nil
-	})
+	token, err := jwtgo.Parse(jwttoken, j.keyFunc)
+	if ve, ok := err.(*jwtgo.ValidationError); ok && ve.Inner != nil {
+		// keep errors of keyFunc, e.g. ErrAlgorithmNotAllowed, as cause.
+		err = ve.Inner
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "jwt.VerifyToken")
 	}
@@ -111,7 +240,19 @@ func (j *JWT) VerifyToken(jwttoken string) (map[string]interface{}, error) {
 		return nil, errors.Wrap(ErrTokenInvalid, "jwt.VerifyToken")
 	}
 
-	return token.Claims.(jwtgo.MapClaims), nil
+	// exp, iat and nbf are verified by Parse when present.
+	claims := token.Claims.(jwtgo.MapClaims)
+	if _, ok := claims["exp"]; !ok && j.ttl > 0 {
+		return nil, errors.Wrap(ErrTokenNoExpiry, "jwt.VerifyToken")
+	}
+	if j.issuer != "" && !claims.VerifyIssuer(j.issuer, true) {
+		return nil, errors.Wrap(ErrIssuerInvalid, "jwt.VerifyToken")
+	}
+	if j.audience != "" && !hasAudience(claims["aud"], j.audience) {
+		return nil, errors.Wrap(ErrAudienceInvalid, "jwt.VerifyToken")
+	}
+
+	return claims, nil
 }
 
 // VerifyClaims verifies claims form user supplied handler.
@@ -143,6 +284,12 @@ func (j *JWT) HTTPMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		err = j.verifyRevocation(r.Context(), claims)
+		if err != nil {
+			j.errHandler(err).ServeHTTP(w, r)
+			return
+		}
+
 		ctx := contextutils.Set(r.Context(), contextutils.Params, claims)
 		r = r.WithContext(ctx)
 
@@ -150,6 +297,103 @@ func (j *JWT) HTTPMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// keyFunc returns key of algorithm of token, only allowed algorithms have one,
+// so that e.g. a HS256 token signed with a public key is rejected.
+func (j *JWT) keyFunc(token *jwtgo.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	if !j.allowed(alg) {
+		return nil, errors.Wrapf(ErrAlgorithmNotAllowed, "alg %s", alg)
+	}
+
+	if _, ok := token.Method.(*jwtgo.SigningMethodHMAC); ok {
+		if j.key == "" {
+			return nil, ErrJWTKeyNotFound
+		}
+		return []byte(j.key), nil
+	}
+
+	pub := j.publicKey
+	if kid, _ := token.Header["kid"].(string); kid != "" && j.keySource != nil {
+		var err error
+		pub, err = j.keySource.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch token.Method.(type) {
+	case *jwtgo.SigningMethodRSA, *jwtgo.SigningMethodRSAPSS:
+		if k, ok := pub.(*rsa.PublicKey); ok {
+			return k, nil
+		}
+	case *jwtgo.SigningMethodECDSA:
+		if k, ok := pub.(*ecdsa.PublicKey); ok {
+			return k, nil
+		}
+	case *signingMethodEdDSA:
+		if k, ok := pub.(ed25519.PublicKey); ok {
+			return k, nil
+		}
+	}
+	return nil, errors.Wrapf(ErrKeyInvalid, "no key of alg %s", alg)
+}
+
+// verifyRevocation returns ErrTokenRevoked if token of claims is revoked,
+// tokens are rejected as well when revocation list can not be read.
+func (j *JWT) verifyRevocation(ctx context.Context, claims map[string]interface{}) error {
+	if j.revocations == nil {
+		return nil
+	}
+
+	revoked, err := j.revocations.Revoked(ctx, claims)
+	if err != nil {
+		return errors.Wrap(err, "jwt.VerifyRevocation")
+	}
+	if revoked {
+		return errors.Wrap(ErrTokenRevoked, "jwt.VerifyRevocation")
+	}
+	return nil
+}
+
+func (j *JWT) allowed(alg string) bool {
+	for _, a := range j.algorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// randomID of 16 random bytes as hex.
+func randomID() (string, error) {
+	b, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func setDefault(claims jwtgo.MapClaims, k string, v interface{}) {
+	if _, ok := claims[k]; !ok {
+		claims[k] = v
+	}
+}
+
+// hasAudience tells if aud claim, a string or a list of them, contains audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (j *JWT) headerToken(r *http.Request) string {
 	if ah := r.Header.Get(j.headerKey); ah != "" {
 		if len(ah) > 6 && strings.ToUpper(ah[0:7]) == "BEARER " {
@@ -1,10 +1,21 @@
 package auth_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"reflect"
 	"testing"
+	"time"
 
 	"bitbucket.org/qubole/wireguard/internal/typeutils"
 	"bitbucket.org/qubole/wireguard/pkg/auth"
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
 )
 
 func TestJWT_Generate(t *testing.T) {
@@ -114,3 +125,226 @@ func TestJWT_VerifyToken(t *testing.T) {
 		})
 	}
 }
+
+func TestJWT_GenerateVerifyToken(t *testing.T) {
+	hourAgo := time.Now().Add(-time.Hour).Unix()
+
+	type options struct {
+		issuer   string
+		audience string
+		ttl      time.Duration
+	}
+	tests := []struct {
+		name      string
+		generate  options
+		verify    options
+		claims    map[string]interface{}
+		want      map[string]interface{}
+		wantErr   bool
+		wantCause error // sentinel error of JWT, nil for errors of exp, iat and nbf
+	}{
+		{
+			name:   "TestRoundTripClaims",
+			claims: map[string]interface{}{"id": 1234, "svc": "test", "sub": "ci-runner"},
+			want:   map[string]interface{}{"id": float64(1234), "svc": "test", "sub": "ci-runner"},
+		},
+		{
+			name:     "TestRoundTripDefaults",
+			generate: options{issuer: "wireguard", audience: "wgapi", ttl: time.Hour},
+			verify:   options{issuer: "wireguard", audience: "wgapi", ttl: time.Hour},
+			claims:   map[string]interface{}{"sub": "ci-runner"},
+			want:     map[string]interface{}{"sub": "ci-runner", "iss": "wireguard", "aud": "wgapi"},
+		},
+		{
+			name:     "TestClaimsOverrideDefaults",
+			generate: options{issuer: "wireguard", audience: "wgapi"},
+			verify:   options{audience: "wgapi"},
+			claims:   map[string]interface{}{"iss": "ci", "aud": []string{"other", "wgapi"}},
+			want:     map[string]interface{}{"iss": "ci", "aud": []interface{}{"other", "wgapi"}},
+		},
+		{
+			name:    "TestExpired",
+			claims:  map[string]interface{}{"exp": hourAgo},
+			wantErr: true,
+		},
+		{
+			name:    "TestNotBefore",
+			claims:  map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()},
+			wantErr: true,
+		},
+		{
+			name:      "TestNoExpiry",
+			verify:    options{ttl: time.Hour},
+			wantErr:   true,
+			wantCause: auth.ErrTokenNoExpiry,
+		},
+		{
+			name:      "TestWrongAudience",
+			generate:  options{audience: "other"},
+			verify:    options{audience: "wgapi"},
+			wantErr:   true,
+			wantCause: auth.ErrAudienceInvalid,
+		},
+		{
+			name:      "TestNoAudience",
+			verify:    options{audience: "wgapi"},
+			wantErr:   true,
+			wantCause: auth.ErrAudienceInvalid,
+		},
+		{
+			name:      "TestWrongIssuer",
+			generate:  options{issuer: "other"},
+			verify:    options{issuer: "wireguard"},
+			wantErr:   true,
+			wantCause: auth.ErrIssuerInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newJWT := func(o options) *auth.JWT {
+				j := auth.NewJWT("my_test_key")
+				j.SetIssuer(o.issuer)
+				j.SetAudience(o.audience)
+				j.SetTTL(o.ttl)
+				return j
+			}
+
+			token, err := newJWT(tt.generate).Generate(tt.claims)
+			if err != nil {
+				t.Fatalf("JWT.Generate() error = %v", err)
+			}
+
+			got, err := newJWT(tt.verify).VerifyToken(token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("JWT.VerifyToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantCause != nil && errors.Cause(err) != tt.wantCause {
+				t.Errorf("JWT.VerifyToken() error = %v, want %v", err, tt.wantCause)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			for k, v := range tt.want {
+				if !reflect.DeepEqual(got[k], v) {
+					t.Errorf("JWT.VerifyToken() %s = %#v, want %#v", k, got[k], v)
+				}
+			}
+			for _, k := range []string{"iat", "nbf", "jti"} {
+				if _, ok := got[k]; !ok {
+					t.Errorf("JWT.VerifyToken() has no %s", k)
+				}
+			}
+			if _, ok := got["exp"]; ok != (tt.generate.ttl > 0) {
+				t.Errorf("JWT.VerifyToken() exp = %v, want exp %v", got["exp"], tt.generate.ttl > 0)
+			}
+		})
+	}
+}
+
+func TestJWT_VerifyTokenAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := publicKeyPEM(t, &rsaKey.PublicKey)
+
+	tests := []struct {
+		name      string
+		algs      []string
+		publicKey []byte
+		method    jwtgo.SigningMethod
+		signKey   interface{}
+		wantCause error
+	}{
+		{name: "TestAlgorithmsHS256Default", method: jwtgo.SigningMethodHS256, signKey: []byte("my_test_key")},
+		{name: "TestAlgorithmsRS256", algs: []string{"RS256"}, publicKey: rsaPEM, method: jwtgo.SigningMethodRS256, signKey: rsaKey},
+		{name: "TestAlgorithmsES256", algs: []string{"ES256"}, publicKey: publicKeyPEM(t, &ecKey.PublicKey), method: jwtgo.SigningMethodES256, signKey: ecKey},
+		{name: "TestAlgorithmsEdDSA", algs: []string{"EdDSA"}, publicKey: publicKeyPEM(t, edPub), method: auth.SigningMethodEdDSA, signKey: edKey},
+		{
+			name: "TestAlgorithmsNotAllowed", publicKey: rsaPEM,
+			method: jwtgo.SigningMethodRS256, signKey: rsaKey, wantCause: auth.ErrAlgorithmNotAllowed,
+		},
+		{
+			// public key is known to anyone, it must never be used as HMAC secret.
+			name: "TestAlgorithmsConfusion", algs: []string{"RS256"}, publicKey: rsaPEM,
+			method: jwtgo.SigningMethodHS256, signKey: rsaPEM, wantCause: auth.ErrAlgorithmNotAllowed,
+		},
+		{
+			name: "TestAlgorithmsKeyTypeMismatch", algs: []string{"RS256", "ES256"}, publicKey: rsaPEM,
+			method: jwtgo.SigningMethodES256, signKey: ecKey, wantCause: auth.ErrKeyInvalid,
+		},
+		{
+			name: "TestAlgorithmsNone", algs: []string{"none"},
+			method: jwtgo.SigningMethodNone, signKey: jwtgo.UnsafeAllowNoneSignatureType, wantCause: auth.ErrKeyInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := auth.NewJWT("my_test_key")
+			if tt.algs != nil {
+				j.SetAlgorithms(tt.algs...)
+			}
+			if tt.publicKey != nil {
+				if err := j.SetPublicKeyPEM(tt.publicKey); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			token, err := jwtgo.NewWithClaims(tt.method, jwtgo.MapClaims{"sub": "ci-runner"}).SignedString(tt.signKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := j.VerifyToken(token)
+			if (err != nil) != (tt.wantCause != nil) {
+				t.Fatalf("JWT.VerifyToken() error = %v, want %v", err, tt.wantCause)
+			}
+			if tt.wantCause != nil {
+				if errors.Cause(err) != tt.wantCause {
+					t.Errorf("JWT.VerifyToken() error = %v, want %v", err, tt.wantCause)
+				}
+				return
+			}
+			if got["sub"] != "ci-runner" {
+				t.Errorf("JWT.VerifyToken() sub = %v, want ci-runner", got["sub"])
+			}
+		})
+	}
+}
+
+func TestJWT_SetPublicKeyPEM(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "TestSetPublicKeyPEMNoBlock", data: []byte("not a pem"), wantErr: true},
+		{name: "TestSetPublicKeyPEMPrivateKey", data: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}}), wantErr: true},
+		{name: "TestSetPublicKeyPEMGarbage", data: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1}}), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := auth.NewJWT("").SetPublicKeyPEM(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("JWT.SetPublicKeyPEM() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func publicKeyPEM(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
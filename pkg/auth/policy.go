@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"bitbucket.org/qubole/wireguard/internal/contextutils"
+)
+
+// Permission of an api caller.
+type Permission string
+
+const (
+	// PermClientOwn allows to create, read, update and delete the client whose id is identity of caller.
+	PermClientOwn = Permission("client:own")
+
+	// PermClientRead allows to read and list any client.
+	PermClientRead = Permission("client:read")
+
+	// PermClientWrite allows to create, update and delete any client.
+	PermClientWrite = Permission("client:write")
+
+	// PermServerAdmin allows to register servers, send their heartbeats and read status.
+	PermServerAdmin = Permission("server:admin")
+
+	// PermTokenAdmin allows to revoke tokens and to create, list and revoke api keys.
+	PermTokenAdmin = Permission("token:admin")
+)
+
+// AllPermissions are granted to admins.
+var AllPermissions = []Permission{PermClientOwn, PermClientRead, PermClientWrite, PermServerAdmin, PermTokenAdmin}
+
+type callerKey struct{}
+
+// Caller of api, its identity and permissions derived from claims by Policy.
+type Caller struct {
+	Subject     string
+	Permissions map[Permission]bool
+}
+
+// ForbiddenError means caller lacks permission on resource.
+type ForbiddenError struct {
+	Subject    string     `json:"subject,omitempty"`
+	Permission Permission `json:"permission"`
+	Resource   string     `json:"resource,omitempty"`
+}
+
+func (e *ForbiddenError) Error() string {
+	return fmt.Sprintf("forbidden:%s lacks %s on %s", e.Subject, e.Permission, e.Resource)
+}
+
+// Can tells if caller has permission.
+func (c *Caller) Can(p Permission) bool {
+	return c.Permissions[p]
+}
+
+// Authorize returns *ForbiddenError unless caller has permission.
+func (c *Caller) Authorize(p Permission, resource string) error {
+	if c.Can(p) {
+		return nil
+	}
+	return &ForbiddenError{Subject: c.Subject, Permission: p, Resource: resource}
+}
+
+// AuthorizeClient returns *ForbiddenError unless caller may read, or write, client of id.
+// Callers with PermClientOwn only get to the client of their own identity.
+func (c *Caller) AuthorizeClient(id string, write bool) error {
+	p := PermClientRead
+	if write {
+		p = PermClientWrite
+	}
+	if c.Can(p) || c.Can(PermClientWrite) {
+		return nil
+	}
+	if c.Can(PermClientOwn) && c.Subject != "" && id == c.Subject {
+		return nil
+	}
+
+	// report what would have allowed it.
+	if c.Can(PermClientOwn) {
+		p = PermClientOwn
+	}
+	return &ForbiddenError{Subject: c.Subject, Permission: p, Resource: "wgclient:" + id}
+}
+
+// CallerFrom returns caller set by Policy.HTTPMiddleware, a caller without permissions if none.
+func CallerFrom(ctx context.Context) *Caller {
+	c, ok := ctx.Value(callerKey{}).(*Caller)
+	if !ok {
+		return &Caller{Permissions: map[Permission]bool{}}
+	}
+	return c
+}
+
+// Policy maps claims of authenticated callers to permissions.
+// Identity is sub claim, permissions are granted by scope claim (space separated or a list,
+// scp is used as well), by groups claim and to every caller by default.
+type Policy struct {
+	defaults []Permission
+	scopes   map[string][]Permission
+	groups   map[string][]Permission
+}
+
+// NewPolicy is constructor, every caller may manage its own client by default and
+// scopes wireguard:client:read, wireguard:client:write and wireguard:admin grant more.
+func NewPolicy() *Policy {
+	return &Policy{
+		defaults: []Permission{PermClientOwn},
+		scopes: map[string][]Permission{
+			"wireguard:client":       {PermClientOwn},
+			"wireguard:client:read":  {PermClientRead},
+			"wireguard:client:write": {PermClientRead, PermClientWrite},
+			"wireguard:admin":        AllPermissions,
+		},
+		groups: map[string][]Permission{},
+	}
+}
+
+// SetDefault sets permissions of every authenticated caller.
+func (p *Policy) SetDefault(perms ...Permission) {
+	p.defaults = perms
+}
+
+// GrantScope grants permissions to callers having scope.
+func (p *Policy) GrantScope(scope string, perms ...Permission) {
+	p.scopes[scope] = append(p.scopes[scope], perms...)
+}
+
+// GrantGroup grants permissions to callers in group.
+func (p *Policy) GrantGroup(group string, perms ...Permission) {
+	p.groups[group] = append(p.groups[group], perms...)
+}
+
+// Caller of claims.
+func (p *Policy) Caller(claims map[string]interface{}) *Caller {
+	c := &Caller{Permissions: map[Permission]bool{}}
+	c.Subject, _ = claims["sub"].(string)
+
+	grant := func(perms []Permission) {
+		for _, perm := range perms {
+			c.Permissions[perm] = true
+		}
+	}
+
+	grant(p.defaults)
+	for _, k := range []string{"scope", "scp"} {
+		for _, s := range claimStrings(claims[k]) {
+			grant(p.scopes[s])
+		}
+	}
+	for _, g := range claimStrings(claims["groups"]) {
+		grant(p.groups[g])
+	}
+	return c
+}
+
+// HTTPMiddleware sets caller of claims put in context by an auth middleware, e.g. JWT.HTTPMiddleware.
+func (p *Policy) HTTPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := p.Caller(contextutils.Get(r.Context(), contextutils.Params))
+
+		ctx := context.WithValue(r.Context(), callerKey{}, c)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ParsePermissions of comma separated list, e.g. of a flag.
+func ParsePermissions(s string) ([]Permission, error) {
+	perms := []Permission{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		p := Permission(v)
+		if !knownPermission(p) {
+			return nil, fmt.Errorf("unknown permission %q", v)
+		}
+		perms = append(perms, p)
+	}
+	return perms, nil
+}
+
+func knownPermission(p Permission) bool {
+	for _, k := range AllPermissions {
+		if k == p {
+			return true
+		}
+	}
+	return false
+}
+
+// claimStrings of a space separated string or a list of strings.
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []string:
+		return v
+	case []interface{}:
+		ss := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
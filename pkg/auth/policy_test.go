@@ -0,0 +1,122 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"bitbucket.org/qubole/wireguard/internal/contextutils"
+	"bitbucket.org/qubole/wireguard/pkg/auth"
+)
+
+func TestPolicy_Caller(t *testing.T) {
+	p := auth.NewPolicy()
+	p.GrantGroup("netops", auth.AllPermissions...)
+	p.GrantScope("monitor", auth.PermServerAdmin)
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   []auth.Permission
+	}{
+		{
+			name:   "TestCallerDefault",
+			claims: map[string]interface{}{"sub": "ci-runner"},
+			want:   []auth.Permission{auth.PermClientOwn},
+		},
+		{
+			name:   "TestCallerScopeString",
+			claims: map[string]interface{}{"sub": "ci-runner", "scope": "openid wireguard:client:read"},
+			want:   []auth.Permission{auth.PermClientOwn, auth.PermClientRead},
+		},
+		{
+			name:   "TestCallerScopeList",
+			claims: map[string]interface{}{"sub": "ci-runner", "scp": []interface{}{"wireguard:client:write", "monitor"}},
+			want:   []auth.Permission{auth.PermClientOwn, auth.PermClientRead, auth.PermClientWrite, auth.PermServerAdmin},
+		},
+		{
+			name:   "TestCallerGroups",
+			claims: map[string]interface{}{"sub": "alice", "groups": []interface{}{"dev", "netops"}},
+			want:   auth.AllPermissions,
+		},
+		{
+			name:   "TestCallerUnknownScope",
+			claims: map[string]interface{}{"sub": "ci-runner", "scope": "wireguard:root", "groups": "dev"},
+			want:   []auth.Permission{auth.PermClientOwn},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Caller(tt.claims)
+
+			want := map[auth.Permission]bool{}
+			for _, perm := range tt.want {
+				want[perm] = true
+			}
+			if got.Subject != tt.claims["sub"] {
+				t.Errorf("Policy.Caller() subject = %s, want %s", got.Subject, tt.claims["sub"])
+			}
+			if !reflect.DeepEqual(got.Permissions, want) {
+				t.Errorf("Policy.Caller() permissions = %v, want %v", got.Permissions, want)
+			}
+		})
+	}
+}
+
+func TestCaller_AuthorizeClient(t *testing.T) {
+	p := auth.NewPolicy()
+
+	tests := []struct {
+		name    string
+		claims  map[string]interface{}
+		id      string
+		write   bool
+		wantErr bool
+	}{
+		{name: "TestOwnRead", claims: map[string]interface{}{"sub": "ci-runner"}, id: "ci-runner"},
+		{name: "TestOwnWrite", claims: map[string]interface{}{"sub": "ci-runner"}, id: "ci-runner", write: true},
+		{name: "TestOtherRead", claims: map[string]interface{}{"sub": "ci-runner"}, id: "alice", wantErr: true},
+		{name: "TestOtherWrite", claims: map[string]interface{}{"sub": "ci-runner"}, id: "alice", write: true, wantErr: true},
+		{name: "TestNoSubject", claims: map[string]interface{}{}, id: "", write: true, wantErr: true},
+		{name: "TestReaderRead", claims: map[string]interface{}{"sub": "ci-runner", "scope": "wireguard:client:read"}, id: "alice"},
+		{name: "TestReaderWrite", claims: map[string]interface{}{"sub": "ci-runner", "scope": "wireguard:client:read"}, id: "alice", write: true, wantErr: true},
+		{name: "TestWriterWrite", claims: map[string]interface{}{"sub": "ci-runner", "scope": "wireguard:client:write"}, id: "alice", write: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Caller(tt.claims).AuthorizeClient(tt.id, tt.write)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Caller.AuthorizeClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, ok := err.(*auth.ForbiddenError); err != nil && !ok {
+				t.Errorf("Caller.AuthorizeClient() error = %T, want *auth.ForbiddenError", err)
+			}
+		})
+	}
+}
+
+func TestPolicy_HTTPMiddleware(t *testing.T) {
+	p := auth.NewPolicy()
+
+	var got *auth.Caller
+	h := p.HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = auth.CallerFrom(r.Context())
+	}))
+
+	r := httptest.NewRequest("GET", "/wgclient", nil)
+	r = r.WithContext(contextutils.Set(r.Context(), contextutils.Params, map[string]interface{}{
+		"sub":   "ci-runner",
+		"scope": "wireguard:admin",
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got == nil || got.Subject != "ci-runner" || !got.Can(auth.PermServerAdmin) {
+		t.Errorf("auth.CallerFrom() = %+v, want admin ci-runner", got)
+	}
+
+	// no middleware, no permissions.
+	if c := auth.CallerFrom(httptest.NewRequest("GET", "/", nil).Context()); c.Can(auth.PermClientOwn) {
+		t.Errorf("auth.CallerFrom() without middleware = %+v, want no permissions", c)
+	}
+}
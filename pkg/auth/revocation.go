@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrTokenRevoked means token, or every token of its subject issued till then, is revoked.
+	ErrTokenRevoked = errors.New("jwt token revoked")
+
+	// ErrRevocationInvalid means revocation has neither a jti nor a subject, or has both.
+	ErrRevocationInvalid = errors.New("revocation needs either jti or sub")
+)
+
+func init() {
+	gob.Register(&Revocation{})
+}
+
+// RevocationList tells if verified claims are of a revoked token, e.g. Revocations.
+type RevocationList interface {
+	Revoked(ctx context.Context, claims map[string]interface{}) (bool, error)
+}
+
+// RevocationStore is store of revocations, e.g. cache.Store.
+type RevocationStore interface {
+	Get(context.Context, string) (interface{}, error)
+	Set(context.Context, string, interface{}, ...int) error
+	Delete(context.Context, string) (interface{}, error)
+	Keys(context.Context, string) ([]string, error)
+}
+
+// Revocation of a token by its jti, or of every token of subject issued till RevokedAt.
+// It is kept till ExpiresAt, when revoked token is expired anyway. Revocations of subjects,
+// and of tokens of unknown exp, have no ExpiresAt as tokens may not expire, they are kept for good.
+type Revocation struct {
+	JTI       string     `json:"jti,omitempty"`
+	Subject   string     `json:"sub,omitempty"`
+	RevokedAt time.Time  `json:"revoked_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired tells if revocation has expiry and it is over at now.
+func (rv *Revocation) Expired(now time.Time) bool {
+	return rv.ExpiresAt != nil && !now.Before(*rv.ExpiresAt)
+}
+
+// Revocations is RevocationList kept in store, so every api instance sharing it rejects revoked tokens.
+type Revocations struct {
+	store RevocationStore
+}
+
+// NewRevocations is constructor of Revocations of store.
+func NewRevocations(store RevocationStore) *Revocations {
+	return &Revocations{store: store}
+}
+
+// Revoke token of jti, or all tokens of subject issued so far.
+// exp is expiry of revoked token, zero if unknown. Only revocations of tokens of known exp expire.
+func (r *Revocations) Revoke(ctx context.Context, jti, sub string, exp time.Time) (*Revocation, error) {
+	if (jti == "") == (sub == "") {
+		return nil, ErrRevocationInvalid
+	}
+
+	now := time.Now()
+	rv := &Revocation{JTI: jti, Subject: sub, RevokedAt: now}
+	if jti != "" && !exp.IsZero() {
+		at := exp.UTC()
+		rv.ExpiresAt = &at
+	}
+	if rv.Expired(now) {
+		// token is expired already.
+		return rv, nil
+	}
+
+	if err := r.store.Set(ctx, r.key(jti, sub), rv); err != nil {
+		return nil, fmt.Errorf("store:set:%v", err)
+	}
+	return rv, nil
+}
+
+// Revoked tells if token of claims is revoked by its jti or subject.
+// Tokens of a revoked subject without iat are revoked, as they can not be told apart.
+func (r *Revocations) Revoked(ctx context.Context, claims map[string]interface{}) (bool, error) {
+	now := time.Now()
+
+	if jti, _ := claims["jti"].(string); jti != "" {
+		rv, err := r.get(ctx, r.key(jti, ""))
+		if err != nil {
+			return false, err
+		}
+		if rv != nil && !rv.Expired(now) {
+			return true, nil
+		}
+	}
+
+	if sub, _ := claims["sub"].(string); sub != "" {
+		rv, err := r.get(ctx, r.key("", sub))
+		if err != nil {
+			return false, err
+		}
+		if rv != nil && !rv.Expired(now) {
+			iat, ok := unixClaim(claims["iat"])
+			if !ok || iat <= rv.RevokedAt.Unix() {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// CronCleanup deletes expired revocations, those without expiry are kept.
+func (r *Revocations) CronCleanup(ctx context.Context) error {
+	keys, err := r.store.Keys(ctx, "revoked:")
+	if err != nil {
+		return fmt.Errorf("store:keys:%v", err)
+	}
+
+	now := time.Now()
+	for _, k := range keys {
+		rv, err := r.get(ctx, k)
+		if err != nil {
+			return err
+		}
+		if rv == nil || !rv.Expired(now) {
+			continue
+		}
+		if _, err := r.store.Delete(ctx, k); err != nil {
+			return fmt.Errorf("store:delete:%v", err)
+		}
+	}
+	return nil
+}
+
+func (r *Revocations) get(ctx context.Context, key string) (*Revocation, error) {
+	v, err := r.store.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("store:get:%v", err)
+	}
+	rv, _ := v.(*Revocation)
+	return rv, nil
+}
+
+func (r *Revocations) key(jti, sub string) string {
+	if jti != "" {
+		return fmt.Sprintf("revoked:jti:%s", jti)
+	}
+	return fmt.Sprintf("revoked:sub:%s", sub)
+}
+
+// unixClaim of a time claim, float64 when parsed from json, int64 in claims of api keys.
+func unixClaim(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
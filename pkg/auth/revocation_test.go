@@ -0,0 +1,176 @@
+package auth_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/pkg/auth"
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+)
+
+func TestRevocations_Revoked(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	r := auth.NewRevocations(cache.NewMap())
+	if _, err := r.Revoke(ctx, "leaked", "", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Revoke(ctx, "", "ci-runner", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   bool
+	}{
+		{name: "TestRevokedJTI", claims: map[string]interface{}{"jti": "leaked", "sub": "alice"}, want: true},
+		{name: "TestOtherJTI", claims: map[string]interface{}{"jti": "other", "sub": "alice"}},
+		{name: "TestRevokedSubject", claims: map[string]interface{}{"jti": "other", "sub": "ci-runner", "iat": float64(now.Unix())}, want: true},
+		{name: "TestRevokedSubjectNoIat", claims: map[string]interface{}{"sub": "ci-runner"}, want: true},
+		{name: "TestSubjectIssuedAfter", claims: map[string]interface{}{"sub": "ci-runner", "iat": float64(now.Add(time.Minute).Unix())}},
+		{name: "TestNoClaims", claims: map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Revoked(ctx, tt.claims)
+			if err != nil {
+				t.Fatalf("Revocations.Revoked() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Revocations.Revoked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := r.Revoke(ctx, "", "", time.Time{}); err != auth.ErrRevocationInvalid {
+		t.Errorf("Revocations.Revoke() error = %v, want %v", err, auth.ErrRevocationInvalid)
+	}
+	if _, err := r.Revoke(ctx, "leaked", "ci-runner", time.Time{}); err != auth.ErrRevocationInvalid {
+		t.Errorf("Revocations.Revoke() error = %v, want %v", err, auth.ErrRevocationInvalid)
+	}
+}
+
+func TestRevocations_CronCleanup(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewMap()
+
+	r := auth.NewRevocations(store)
+	r.Revoke(ctx, "short", "", time.Now().Add(time.Second))
+	r.Revoke(ctx, "long", "", time.Now().Add(time.Hour))
+	r.Revoke(ctx, "unknown-exp", "", time.Time{})
+	r.Revoke(ctx, "", "ci-runner", time.Time{})
+
+	// expired tokens need no revocation.
+	r.Revoke(ctx, "expired", "", time.Now().Add(-time.Minute))
+
+	time.Sleep(1100 * time.Millisecond)
+	if err := r.CronCleanup(ctx); err != nil {
+		t.Fatalf("Revocations.CronCleanup() error = %v", err)
+	}
+
+	keys, _ := store.Keys(ctx, "revoked:")
+	sort.Strings(keys)
+	want := []string{"revoked:jti:long", "revoked:jti:unknown-exp", "revoked:sub:ci-runner"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Revocations.CronCleanup() kept %v, want %v", keys, want)
+	}
+	if revoked, _ := r.Revoked(ctx, map[string]interface{}{"jti": "long"}); !revoked {
+		t.Errorf("Revocations.Revoked() = false after cleanup, want true")
+	}
+}
+
+// Tokens generated without -jwt-ttl never expire, so their revocations must not either.
+func TestRevocations_NoTTL(t *testing.T) {
+	ctx := context.Background()
+
+	j := auth.NewJWT("my_test_key")
+	r := auth.NewRevocations(cache.NewMap())
+
+	leaked, _ := j.Generate(map[string]interface{}{"sub": "alice"})
+	old, _ := j.Generate(map[string]interface{}{"sub": "ci-runner"})
+	for _, token := range []string{leaked, old} {
+		claims, err := j.VerifyToken(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := claims["exp"]; ok {
+			t.Fatalf("JWT.Generate() exp = %v, want none", claims["exp"])
+		}
+	}
+
+	lc, _ := j.VerifyToken(leaked)
+	rv, err := r.Revoke(ctx, lc["jti"].(string), "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv.ExpiresAt != nil {
+		t.Errorf("Revocations.Revoke() expires_at = %v, want none", rv.ExpiresAt)
+	}
+	rv, err = r.Revoke(ctx, "", "ci-runner", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv.ExpiresAt != nil {
+		t.Errorf("Revocations.Revoke() subject expires_at = %v, want none", rv.ExpiresAt)
+	}
+
+	if err := r.CronCleanup(ctx); err != nil {
+		t.Fatalf("Revocations.CronCleanup() error = %v", err)
+	}
+	for _, token := range []string{leaked, old} {
+		claims, _ := j.VerifyToken(token)
+		if revoked, err := r.Revoked(ctx, claims); err != nil || !revoked {
+			t.Errorf("Revocations.Revoked() %s = %v, %v, want revoked", claims["sub"], revoked, err)
+		}
+	}
+}
+
+func TestJWT_HTTPMiddlewareRevoked(t *testing.T) {
+	ctx := context.Background()
+
+	revocations := auth.NewRevocations(cache.NewMap())
+	j := auth.NewJWT("my_test_key")
+	j.SetRevocationList(revocations)
+
+	h := j.HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(token string) int {
+		r := httptest.NewRequest("GET", "/wgclient", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	token, err := j.Generate(map[string]interface{}{"sub": "ci-runner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := j.VerifyToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := serve(token); code != http.StatusOK {
+		t.Fatalf("JWT.HTTPMiddleware() status = %d, want %d", code, http.StatusOK)
+	}
+
+	if _, err := revocations.Revoke(ctx, claims["jti"].(string), "", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(token); code != http.StatusUnauthorized {
+		t.Errorf("JWT.HTTPMiddleware() revoked token status = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// other tokens of subject are still accepted.
+	other, _ := j.Generate(map[string]interface{}{"sub": "ci-runner"})
+	if code := serve(other); code != http.StatusOK {
+		t.Errorf("JWT.HTTPMiddleware() other token status = %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,329 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltSchemaVersion = 1
+
+var (
+	boltMeta    = []byte("meta")
+	boltKV      = []byte("kv")
+	boltVersion = []byte("schema_version")
+
+	// boltMigrations[i] migrates schema version i to i+1.
+	boltMigrations = []func(*bolt.Tx) error{
+		// 0 -> 1: key values in kv bucket.
+		func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltKV)
+			return err
+		},
+	}
+)
+
+// boltValue is how a value is kept on disk, T names type of V.
+type boltValue struct {
+	T   string          `json:"t"`
+	V   json.RawMessage `json:"v"`
+	Exp int64           `json:"exp,omitempty"` // unix nano
+}
+
+// Bolt cache, a single file store for one node deployments.
+// Every write is a fsync'ed bolt transaction so state survives crashes and restarts.
+// Values are json of their type, only the types given to NewBolt and bool, int, string
+// and time.Time can be stored.
+type Bolt struct {
+	db    *bolt.DB
+	types map[string]reflect.Type
+}
+
+// NewBolt opens or creates bolt file at path and migrates it to current schema.
+// types are sample values of types stored, e.g. &wgclient.WGClient{}.
+func NewBolt(path string, types ...interface{}) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Bolt{db: db, types: map[string]reflect.Type{}}
+	for _, t := range append([]interface{}{false, 0, "", time.Time{}}, types...) {
+		c.types[typeName(t)] = reflect.TypeOf(t)
+	}
+
+	if err := c.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close bolt file.
+func (c *Bolt) Close() error {
+	return c.db.Close()
+}
+
+// SchemaVersion of bolt file.
+func (c *Bolt) SchemaVersion() (int, error) {
+	var v int
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		v, err = schemaVersion(tx)
+		return err
+	})
+	return v, err
+}
+
+// Get key
+func (c *Bolt) Get(ctx context.Context, key string) (interface{}, error) {
+	var v interface{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		v, err = c.get(tx, key, time.Now())
+		return err
+	})
+	return v, err
+}
+
+// Delete key
+func (c *Bolt) Delete(ctx context.Context, key string) (interface{}, error) {
+	var v interface{}
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		v, err = c.get(tx, key, time.Now())
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltKV).Delete([]byte(key))
+	})
+	return v, err
+}
+
+// Set key val, optional ttl is in seconds, a nil val deletes key.
+func (c *Bolt) Set(ctx context.Context, key string, val interface{}, ttl ...int) error {
+	var exp time.Time
+	if len(ttl) > 0 && ttl[0] > 0 {
+		exp = time.Now().Add(time.Duration(ttl[0]) * time.Second)
+	}
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return c.put(tx, key, val, exp)
+	})
+}
+
+// Inc a key.
+func (c *Bolt) Inc(ctx context.Context, key string) (int, error) {
+	var n int
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		v, err := c.get(tx, key, time.Now())
+		if err != nil {
+			return err
+		}
+
+		n, _ = v.(int)
+		n++
+		return c.put(tx, key, n, time.Time{})
+	})
+	return n, err
+}
+
+// Keys with prefix in sorted order.
+func (c *Bolt) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		keys, err = c.keys(tx, prefix, time.Now())
+		return err
+	})
+	return keys, err
+}
+
+// DeleteExpired purges expired keys, reads only hide them, so the file would grow forever otherwise.
+func (c *Bolt) DeleteExpired(ctx context.Context) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		b := tx.Bucket(boltKV)
+
+		// keys are collected first, deleting under a cursor skips the next key.
+		var keys [][]byte
+		err := b.ForEach(func(k, data []byte) error {
+			var bv boltValue
+			if err := json.Unmarshal(data, &bv); err != nil {
+				return fmt.Errorf("bolt:%s:%v", k, err)
+			}
+			if expired(bv.Exp, now) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return fmt.Errorf("bolt:%s:%v", k, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Update runs fn in a bolt read-write transaction, bolt serializes them.
+func (c *Bolt) Update(ctx context.Context, fn func(Tx) error) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{c: c, tx: tx, now: time.Now()})
+	})
+}
+
+type boltTx struct {
+	c   *Bolt
+	tx  *bolt.Tx
+	now time.Time
+}
+
+func (tx *boltTx) Get(key string) (interface{}, error) {
+	return tx.c.get(tx.tx, key, tx.now)
+}
+
+func (tx *boltTx) Set(key string, val interface{}, ttl ...int) error {
+	var exp time.Time
+	if len(ttl) > 0 && ttl[0] > 0 {
+		exp = tx.now.Add(time.Duration(ttl[0]) * time.Second)
+	}
+	return tx.c.put(tx.tx, key, val, exp)
+}
+
+func (tx *boltTx) Delete(key string) error {
+	return tx.tx.Bucket(boltKV).Delete([]byte(key))
+}
+
+func (tx *boltTx) Keys(prefix string) ([]string, error) {
+	return tx.c.keys(tx.tx, prefix, tx.now)
+}
+
+func (c *Bolt) keys(tx *bolt.Tx, prefix string, now time.Time) ([]string, error) {
+	keys := []string{}
+	cur := tx.Bucket(boltKV).Cursor()
+
+	// bolt keeps keys sorted.
+	for k, data := cur.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, data = cur.Next() {
+		var bv boltValue
+		if err := json.Unmarshal(data, &bv); err != nil {
+			return nil, fmt.Errorf("bolt:%s:%v", k, err)
+		}
+		if !expired(bv.Exp, now) {
+			keys = append(keys, string(k))
+		}
+	}
+	return keys, nil
+}
+
+func (c *Bolt) get(tx *bolt.Tx, key string, now time.Time) (interface{}, error) {
+	data := tx.Bucket(boltKV).Get([]byte(key))
+	if data == nil {
+		return nil, nil
+	}
+
+	var bv boltValue
+	if err := json.Unmarshal(data, &bv); err != nil {
+		return nil, fmt.Errorf("bolt:%s:%v", key, err)
+	}
+	if expired(bv.Exp, now) {
+		return nil, nil
+	}
+
+	t, ok := c.types[bv.T]
+	if !ok {
+		return nil, fmt.Errorf("bolt:%s:unknown type %s", key, bv.T)
+	}
+
+	ptr := reflect.New(t)
+	if err := json.Unmarshal(bv.V, ptr.Interface()); err != nil {
+		return nil, fmt.Errorf("bolt:%s:%v", key, err)
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+func (c *Bolt) put(tx *bolt.Tx, key string, val interface{}, exp time.Time) error {
+	if val == nil {
+		return tx.Bucket(boltKV).Delete([]byte(key))
+	}
+
+	name := typeName(val)
+	if _, ok := c.types[name]; !ok {
+		return fmt.Errorf("bolt:%s:unknown type %s", key, name)
+	}
+
+	v, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("bolt:%s:%v", key, err)
+	}
+
+	bv := boltValue{T: name, V: v}
+	if !exp.IsZero() {
+		bv.Exp = exp.UnixNano()
+	}
+
+	data, err := json.Marshal(bv)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltKV).Put([]byte(key), data)
+}
+
+// migrate runs migrations from schema version of file up to boltSchemaVersion in one transaction.
+func (c *Bolt) migrate() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMeta)
+		if err != nil {
+			return err
+		}
+
+		v, err := schemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if v > boltSchemaVersion {
+			return fmt.Errorf("bolt:schema version %d is newer than supported %d", v, boltSchemaVersion)
+		}
+
+		for ; v < boltSchemaVersion; v++ {
+			if err := boltMigrations[v](tx); err != nil {
+				return fmt.Errorf("bolt:migrate:%d:%v", v+1, err)
+			}
+		}
+
+		return meta.Put(boltVersion, []byte(fmt.Sprint(v)))
+	})
+}
+
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket(boltMeta)
+	if meta == nil {
+		return 0, nil
+	}
+
+	data := meta.Get(boltVersion)
+	if data == nil {
+		return 0, nil
+	}
+
+	var v int
+	_, err := fmt.Sscan(string(data), &v)
+	return v, err
+}
+
+func typeName(v interface{}) string {
+	return reflect.TypeOf(v).String()
+}
+
+func expired(exp int64, now time.Time) bool {
+	return exp != 0 && now.UnixNano() >= exp
+}
@@ -0,0 +1,184 @@
+package cache_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBolt(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.db")
+
+	c, err := cache.NewBolt(path, &value{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		val     interface{}
+		wantErr bool
+	}{
+		{name: "TestBoltStruct", key: "wgclient:1", val: &value{ID: "1", IPs: []string{"10.0.0.2"}}},
+		{name: "TestBoltBool", key: "ip:reserved:10.0.0.2", val: true},
+		{name: "TestBoltTime", key: "wgserver:1:heartbeat", val: time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)},
+		{name: "TestBoltUnknownType", key: "x", val: struct{}{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.Set(ctx, tt.key, tt.val)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Bolt.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got, err := c.Get(ctx, tt.key)
+			if err != nil || !reflect.DeepEqual(got, tt.val) {
+				t.Errorf("Bolt.Get() = %#v, %v, want %#v", got, err, tt.val)
+			}
+		})
+	}
+
+	c.Set(ctx, "alive", true, 1)
+	c.Inc(ctx, "iterator")
+	c.Delete(ctx, "ip:reserved:10.0.0.2")
+
+	// state survives reopen.
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c, err = cache.NewBolt(path, &value{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if n, err := c.Inc(ctx, "iterator"); err != nil || n != 2 {
+		t.Errorf("Bolt.Inc() after reopen = %d, %v, want 2", n, err)
+	}
+	got, err := c.Get(ctx, "wgclient:1")
+	if want := (&value{ID: "1", IPs: []string{"10.0.0.2"}}); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Bolt.Get() after reopen = %#v, %v, want %#v", got, err, want)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	keys, err := c.Keys(ctx, "")
+	if want := []string{"iterator", "wgclient:1", "wgserver:1:heartbeat"}; err != nil || !reflect.DeepEqual(keys, want) {
+		t.Errorf("Bolt.Keys() = %v, %v, want %v", keys, err, want)
+	}
+}
+
+func TestNewBolt_Migrate(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string // on disk before open, empty for a new file
+		wantErr bool
+	}{
+		{name: "TestMigrateNewFile"},
+		{name: "TestMigrateUnversioned", version: "0"},
+		{name: "TestMigrateCurrent", version: "1"},
+		{name: "TestMigrateNewer", version: "99", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bolt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "store.db")
+
+			if tt.version != "" {
+				db, err := bolt.Open(path, 0600, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				db.Update(func(tx *bolt.Tx) error {
+					if tt.version != "0" {
+						tx.CreateBucketIfNotExists([]byte("kv"))
+					}
+					b, _ := tx.CreateBucketIfNotExists([]byte("meta"))
+					return b.Put([]byte("schema_version"), []byte(tt.version))
+				})
+				db.Close()
+			}
+
+			c, err := cache.NewBolt(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewBolt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer c.Close()
+
+			if v, err := c.SchemaVersion(); err != nil || v != 1 {
+				t.Errorf("Bolt.SchemaVersion() = %d, %v, want 1", v, err)
+			}
+			if _, err := c.Inc(context.Background(), "iterator"); err != nil {
+				t.Errorf("Bolt.Inc() after migrate error = %v", err)
+			}
+		})
+	}
+}
+
+func TestBolt_DeleteExpired(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.db")
+
+	c, err := cache.NewBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"ttl:a", "ttl:b", "ttl:c"} {
+		c.Set(ctx, k, true, 1)
+	}
+	c.Set(ctx, "b", true)
+
+	time.Sleep(1100 * time.Millisecond)
+	if err := c.DeleteExpired(ctx); err != nil {
+		t.Fatalf("Bolt.DeleteExpired() error = %v", err)
+	}
+	c.Close()
+
+	// expired keys are gone from file, not only hidden.
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []string
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("kv")).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if !reflect.DeepEqual(keys, []string{"b"}) {
+		t.Errorf("Bolt.DeleteExpired() kept keys %v, want [b]", keys)
+	}
+}
@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrTxConflict is returned by Update when keys read by transaction kept changing concurrently.
+var ErrTxConflict = errors.New("store:tx:conflict")
+
+// Store is key value contract of Map, Redis and Bolt.
+// Set takes an optional ttl in seconds, setting a nil value deletes key.
+type Store interface {
+	Get(context.Context, string) (interface{}, error)
+	Set(context.Context, string, interface{}, ...int) error
+	Delete(context.Context, string) (interface{}, error)
+	Inc(context.Context, string) (int, error)
+	Keys(context.Context, string) ([]string, error)
+	Update(context.Context, func(Tx) error) error
+}
+
+// Tx is a multi key transaction of Update.
+// Reads see writes of the same transaction, writes are applied all together when fn
+// of Update returns nil and none of them otherwise.
+// fn may be run more than once, so it must not have side effects besides Tx.
+// As of Store, setting a nil value deletes key.
+type Tx interface {
+	Get(string) (interface{}, error)
+	Set(string, interface{}, ...int) error
+	Delete(string) error
+	Keys(string) ([]string, error)
+}
+
+// txWrite is a buffered write of Tx, a nil val is a delete.
+type txWrite struct {
+	val interface{}
+	ttl int
+}
@@ -0,0 +1,157 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+	"github.com/alicebob/miniredis"
+)
+
+func TestStore_Update(t *testing.T) {
+	ctx := context.Background()
+
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	r := cache.NewRedis(m.Addr(), "", 0)
+	defer r.Close()
+
+	dir, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := cache.NewBolt(filepath.Join(dir, "store.db"), &value{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	tests := []struct {
+		name  string
+		store cache.Store
+		// miniredis answers an aborted EXEC with an empty array instead of nil,
+		// go-redis then waits for replies forever, so conflicts are not tested on it.
+		skipConcurrent bool
+	}{
+		{name: "TestUpdateMap", store: cache.NewMap()},
+		{name: "TestUpdateRedis", store: r, skipConcurrent: true},
+		{name: "TestUpdateBolt", store: b},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.store
+			if err := c.Set(ctx, "tx:old", true); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Set(ctx, "tx:nil", true); err != nil {
+				t.Fatal(err)
+			}
+
+			// writes are visible within tx and applied together.
+			err := c.Update(ctx, func(tx cache.Tx) error {
+				if err := tx.Set("tx:a", &value{ID: "a"}); err != nil {
+					return err
+				}
+				if err := tx.Delete("tx:old"); err != nil {
+					return err
+				}
+				// a nil value is a delete.
+				if err := tx.Set("tx:nil", nil); err != nil {
+					return err
+				}
+
+				keys, err := tx.Keys("tx:")
+				if err != nil || !reflect.DeepEqual(keys, []string{"tx:a"}) {
+					t.Errorf("Tx.Keys() = %v, %v, want [tx:a]", keys, err)
+				}
+				v, err := tx.Get("tx:a")
+				if err != nil || !reflect.DeepEqual(v, &value{ID: "a"}) {
+					t.Errorf("Tx.Get() = %v, %v, want own write", v, err)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+			if keys, err := c.Keys(ctx, "tx:"); err != nil || !reflect.DeepEqual(keys, []string{"tx:a"}) {
+				t.Errorf("Keys() after commit = %v, %v, want [tx:a]", keys, err)
+			}
+
+			if err := c.Set(ctx, "nil", true); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Set(ctx, "nil", nil); err != nil {
+				t.Fatalf("Set() nil error = %v", err)
+			}
+			if keys, err := c.Keys(ctx, "nil"); err != nil || len(keys) != 0 {
+				t.Errorf("Keys() after Set() nil = %v, %v, want none", keys, err)
+			}
+
+			// an error discards all writes.
+			abort := errors.New("abort")
+			err = c.Update(ctx, func(tx cache.Tx) error {
+				tx.Set("tx:b", true)
+				tx.Delete("tx:a")
+				return abort
+			})
+			if err != abort {
+				t.Fatalf("Update() error = %v, want %v", err, abort)
+			}
+			if keys, err := c.Keys(ctx, "tx:"); err != nil || !reflect.DeepEqual(keys, []string{"tx:a"}) {
+				t.Errorf("Keys() after abort = %v, %v, want [tx:a]", keys, err)
+			}
+
+			if tt.skipConcurrent {
+				return
+			}
+
+			// read-modify-write of concurrent transactions is not lost.
+			var (
+				wg        sync.WaitGroup
+				mu        sync.Mutex
+				committed int
+			)
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					err := c.Update(ctx, func(tx cache.Tx) error {
+						v, err := tx.Get("tx:n")
+						if err != nil {
+							return err
+						}
+						n, _ := v.(int)
+						return tx.Set("tx:n", n+1)
+					})
+					if err != nil {
+						t.Errorf("Update() error = %v", err)
+						return
+					}
+					mu.Lock()
+					committed++
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+
+			v, err := c.Get(ctx, "tx:n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n, _ := v.(int); n != 20 || committed != 20 {
+				t.Errorf("Get() counter = %v after %d commits, want 20", v, committed)
+			}
+		})
+	}
+}
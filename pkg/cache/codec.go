@@ -0,0 +1,31 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+)
+
+func init() {
+	gob.Register(time.Time{})
+}
+
+// entry wraps stored values so that gob keeps their concrete type.
+// Types stored as values must be registered with gob.Register by their package.
+type entry struct {
+	V interface{}
+}
+
+// encode value for stores keeping bytes.
+func encode(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(&entry{V: v})
+	return b.Bytes(), err
+}
+
+// decode value encoded by encode.
+func decode(data []byte) (interface{}, error) {
+	var e entry
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e)
+	return e.V, err
+}
@@ -3,28 +3,65 @@ package cache
 import (
 	"context"
 	"encoding/json"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
+// ExpireFunc is called with key and value of an expired key.
+type ExpireFunc func(key string, val interface{})
+
 // Map cache
+// Keys set with a ttl are gone once it is over, they are evicted on access or by Janitor,
+// which is when ExpireFuncs of OnExpire are called.
 type Map struct {
 	sync.RWMutex
-	c map[string]interface{}
+	c   map[string]interface{}
+	exp map[string]time.Time
+
+	onExpire []onExpire
+}
+
+type onExpire struct {
+	prefix string
+	fn     ExpireFunc
+}
+
+type expiredKey struct {
+	key string
+	val interface{}
 }
 
 //NewMap is contructor.
 func NewMap() *Map {
 	return &Map{
-		c: make(map[string]interface{}),
+		c:   make(map[string]interface{}),
+		exp: make(map[string]time.Time),
 	}
 }
 
-// Get key
+// OnExpire calls fn for every expired key with prefix, once it is evicted.
+// A key set again before it is evicted does not expire. fn runs without lock of map held,
+// so it may use map. OnExpire must be called before map is used.
+func (c *Map) OnExpire(prefix string, fn ExpireFunc) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.onExpire = append(c.onExpire, onExpire{prefix: prefix, fn: fn})
+}
+
+// Get key, an expired key is evicted.
 func (c *Map) Get(ctx context.Context, key string) (interface{}, error) {
 	c.RLock()
-	defer c.RUnlock()
-
 	v, _ := c.c[key]
+	expired := c.expired(key, time.Now())
+	c.RUnlock()
+
+	if expired {
+		c.evict(key)
+		return nil, nil
+	}
 	return v, nil
 }
 
@@ -36,34 +73,227 @@ func (c *Map) Delete(ctx context.Context, key string) (interface{}, error) {
 	defer c.Unlock()
 
 	delete(c.c, key)
+	delete(c.exp, key)
 	return v, nil
 }
 
-// Set key val
+// Set key val, optional ttl is in seconds, a nil val deletes key.
 func (c *Map) Set(ctx context.Context, key string, val interface{}, ttl ...int) error {
 	c.Lock()
 	defer c.Unlock()
 
+	delete(c.exp, key)
+	if val == nil {
+		delete(c.c, key)
+		return nil
+	}
+
 	c.c[key] = val
+	if len(ttl) > 0 && ttl[0] > 0 {
+		c.exp[key] = time.Now().Add(time.Duration(ttl[0]) * time.Second)
+	}
 	return nil
 }
 
 // Inc a key.
 func (c *Map) Inc(ctx context.Context, key string) (int, error) {
 	c.Lock()
-	defer c.Unlock()
+	var expired []expiredKey
+	if e, ok := c.remove(key, time.Now()); ok {
+		expired = append(expired, e)
+	}
 
 	v, _ := c.c[key].(int)
 	v++
 	c.c[key] = v
+	c.Unlock()
 
+	c.notify(expired)
 	return v, nil
 }
 
+// Keys with prefix in sorted order.
+func (c *Map) Keys(ctx context.Context, prefix string) ([]string, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	now := time.Now()
+	keys := []string{}
+	for k := range c.c {
+		if strings.HasPrefix(k, prefix) && !c.expired(k, now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Update runs fn as a transaction holding lock of map, so transactions are serialized.
+func (c *Map) Update(ctx context.Context, fn func(Tx) error) error {
+	c.Lock()
+	defer c.Unlock()
+
+	tx := &mapTx{m: c, now: time.Now(), writes: map[string]*txWrite{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	for k, w := range tx.writes {
+		delete(c.exp, k)
+		if w.val == nil {
+			delete(c.c, k)
+			continue
+		}
+
+		c.c[k] = w.val
+		if w.ttl > 0 {
+			c.exp[k] = tx.now.Add(time.Duration(w.ttl) * time.Second)
+		}
+	}
+	return nil
+}
+
+type mapTx struct {
+	m      *Map
+	now    time.Time
+	writes map[string]*txWrite
+}
+
+func (tx *mapTx) Get(key string) (interface{}, error) {
+	if w, ok := tx.writes[key]; ok {
+		return w.val, nil
+	}
+	if tx.m.expired(key, tx.now) {
+		return nil, nil
+	}
+	return tx.m.c[key], nil
+}
+
+func (tx *mapTx) Set(key string, val interface{}, ttl ...int) error {
+	w := &txWrite{val: val}
+	if len(ttl) > 0 {
+		w.ttl = ttl[0]
+	}
+	tx.writes[key] = w
+	return nil
+}
+
+func (tx *mapTx) Delete(key string) error {
+	tx.writes[key] = &txWrite{}
+	return nil
+}
+
+func (tx *mapTx) Keys(prefix string) ([]string, error) {
+	keys := []string{}
+	for k := range tx.m.c {
+		if _, ok := tx.writes[k]; !ok && strings.HasPrefix(k, prefix) && !tx.m.expired(k, tx.now) {
+			keys = append(keys, k)
+		}
+	}
+	for k, w := range tx.writes {
+		if w.val != nil && strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// DeleteExpired evicts all expired keys.
+func (c *Map) DeleteExpired() {
+	c.Lock()
+	now := time.Now()
+	var expired []expiredKey
+	for k := range c.exp {
+		if e, ok := c.remove(k, now); ok {
+			expired = append(expired, e)
+		}
+	}
+	c.Unlock()
+
+	c.notify(expired)
+}
+
+// Janitor returns a goroutine which evicts expired keys every interval till stop is closed.
+func (c *Map) Janitor(interval time.Duration) func(<-chan struct{}) error {
+	return func(stop <-chan struct{}) error {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return nil
+			case <-t.C:
+				c.DeleteExpired()
+			}
+		}
+	}
+}
+
+// evict key if it is expired.
+func (c *Map) evict(key string) {
+	c.Lock()
+	e, ok := c.remove(key, time.Now())
+	c.Unlock()
+
+	if ok {
+		c.notify([]expiredKey{e})
+	}
+}
+
+// remove key if it is expired, lock must be held.
+// Only the caller removing a key gets it, so callbacks run once per expiry.
+func (c *Map) remove(key string, now time.Time) (expiredKey, bool) {
+	if !c.expired(key, now) {
+		return expiredKey{}, false
+	}
+
+	e := expiredKey{key: key, val: c.c[key]}
+	delete(c.c, key)
+	delete(c.exp, key)
+	return e, true
+}
+
+// notify calls ExpireFuncs of expired keys, lock must not be held.
+func (c *Map) notify(expired []expiredKey) {
+	if len(expired) == 0 {
+		return
+	}
+
+	c.RLock()
+	fns := c.onExpire
+	c.RUnlock()
+
+	for _, e := range expired {
+		for _, o := range fns {
+			if strings.HasPrefix(e.key, o.prefix) {
+				o.fn(e.key, e.val)
+			}
+		}
+	}
+}
+
 func (c *Map) String() string {
 	c.RLock()
 	defer c.RUnlock()
 
-	d, _ := json.Marshal(c.c)
+	now := time.Now()
+	m := make(map[string]interface{}, len(c.c))
+	for k, v := range c.c {
+		if !c.expired(k, now) {
+			m[k] = v
+		}
+	}
+
+	d, _ := json.Marshal(m)
 	return string(d)
 }
+
+// expired tells if ttl of key is over, lock must be held.
+func (c *Map) expired(key string, now time.Time) bool {
+	e, ok := c.exp[key]
+	return ok && !now.Before(e)
+}
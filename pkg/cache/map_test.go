@@ -0,0 +1,89 @@
+package cache_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+)
+
+func TestMap_SetTTL(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewMap()
+
+	c.Set(ctx, "a", 1, 1)
+	c.Set(ctx, "b", 2)
+	c.Set(ctx, "c", 3, 1)
+	c.Set(ctx, "c", 3) // set without ttl keeps key forever
+
+	if v, _ := c.Get(ctx, "a"); v != 1 {
+		t.Fatalf("Map.Get() = %v before ttl, want 1", v)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if v, _ := c.Get(ctx, "a"); v != nil {
+		t.Errorf("Map.Get() = %v after ttl, want nil", v)
+	}
+	if keys, _ := c.Keys(ctx, ""); !reflect.DeepEqual(keys, []string{"b", "c"}) {
+		t.Errorf("Map.Keys() = %v, want [b c]", keys)
+	}
+	if n, _ := c.Inc(ctx, "a"); n != 1 {
+		t.Errorf("Map.Inc() of expired key = %d, want 1", n)
+	}
+}
+
+func TestMap_OnExpire(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		evict func(c *cache.Map)
+	}{
+		{name: "TestOnExpireGet", evict: func(c *cache.Map) { c.Get(ctx, "ttl:a") }},
+		{name: "TestOnExpireDeleteExpired", evict: func(c *cache.Map) { c.DeleteExpired() }},
+		{
+			name: "TestOnExpireJanitor",
+			evict: func(c *cache.Map) {
+				stop := make(chan struct{})
+				done := make(chan error)
+				go func() { done <- c.Janitor(10 * time.Millisecond)(stop) }()
+
+				time.Sleep(50 * time.Millisecond)
+				close(stop)
+				if err := <-done; err != nil {
+					t.Errorf("Map.Janitor() error = %v", err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cache.NewMap()
+
+			var got []string
+			c.OnExpire("ttl:", func(key string, val interface{}) {
+				// callbacks may use map.
+				c.Set(ctx, "expired:"+key, val)
+				got = append(got, key)
+			})
+
+			c.Set(ctx, "ttl:a", 1, 1)
+			c.Set(ctx, "ttl:b", 2)
+			c.Set(ctx, "other", 3, 1)
+
+			time.Sleep(1100 * time.Millisecond)
+			tt.evict(c)
+			c.DeleteExpired() // evicted keys are not expired twice
+
+			if !reflect.DeepEqual(got, []string{"ttl:a"}) {
+				t.Errorf("OnExpire() keys = %v, want [ttl:a]", got)
+			}
+			if v, _ := c.Get(ctx, "expired:ttl:a"); v != 1 {
+				t.Errorf("OnExpire() val = %v, want 1", v)
+			}
+		})
+	}
+}
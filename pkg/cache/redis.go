@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Redis cache
+// Values are gob encoded, counters of Inc are plain redis integers.
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis is constructor.
+func NewRedis(addr, password string, db int) *Redis {
+	return &Redis{
+		client: redis.NewClient(&redis.Options{Addr: addr, Password: password, DB: db}),
+	}
+}
+
+// Ping checks connection to redis.
+func (c *Redis) Ping(ctx context.Context) error {
+	return c.client.WithContext(ctx).Ping().Err()
+}
+
+// Close connections to redis.
+func (c *Redis) Close() error {
+	return c.client.Close()
+}
+
+// Get key
+func (c *Redis) Get(ctx context.Context, key string) (interface{}, error) {
+	b, err := c.client.WithContext(ctx).Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeRedis(b)
+}
+
+// Delete key
+func (c *Redis) Delete(ctx context.Context, key string) (interface{}, error) {
+	v, err := c.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.client.WithContext(ctx).Del(key).Err()
+	return v, err
+}
+
+// Set key val, optional ttl is in seconds, a nil val deletes key.
+func (c *Redis) Set(ctx context.Context, key string, val interface{}, ttl ...int) error {
+	if val == nil {
+		return c.client.WithContext(ctx).Del(key).Err()
+	}
+
+	b, err := encode(val)
+	if err != nil {
+		return err
+	}
+
+	var exp time.Duration
+	if len(ttl) > 0 && ttl[0] > 0 {
+		exp = time.Duration(ttl[0]) * time.Second
+	}
+	return c.client.WithContext(ctx).Set(key, b, exp).Err()
+}
+
+// Inc a key atomically.
+func (c *Redis) Inc(ctx context.Context, key string) (int, error) {
+	n, err := c.client.WithContext(ctx).Incr(key).Result()
+	return int(n), err
+}
+
+// Keys with prefix in sorted order.
+func (c *Redis) Keys(ctx context.Context, prefix string) ([]string, error) {
+	client := c.client.WithContext(ctx)
+	match := globEscaper.Replace(prefix) + "*"
+
+	keys := []string{}
+	seen := map[string]struct{}{}
+
+	var cursor uint64
+	for {
+		ks, next, err := client.Scan(cursor, match, 1000).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		// scan may return a key more than once.
+		for _, k := range ks {
+			if _, ok := seen[k]; !ok {
+				seen[k] = struct{}{}
+				keys = append(keys, k)
+			}
+		}
+
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Update runs fn as an optimistic transaction: keys read by fn are watched and
+// writes are applied with MULTI/EXEC. When a watched key changes meanwhile fn is run
+// again, ErrTxConflict is returned after redisTxRetries attempts.
+// Keys of Tx are not watched, only the keys read with Get.
+func (c *Redis) Update(ctx context.Context, fn func(Tx) error) error {
+	client := c.client.WithContext(ctx)
+
+	for i := 0; i < redisTxRetries; i++ {
+		err := client.Watch(func(rtx *redis.Tx) error {
+			tx := &redisTx{ctx: ctx, c: c, tx: rtx, writes: map[string]*txWrite{}}
+			if err := fn(tx); err != nil {
+				return err
+			}
+			return tx.commit()
+		})
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return err
+	}
+	return ErrTxConflict
+}
+
+const redisTxRetries = 10
+
+type redisTx struct {
+	ctx    context.Context
+	c      *Redis
+	tx     *redis.Tx
+	writes map[string]*txWrite
+}
+
+func (tx *redisTx) Get(key string) (interface{}, error) {
+	if w, ok := tx.writes[key]; ok {
+		return w.val, nil
+	}
+
+	if err := tx.tx.Watch(key).Err(); err != nil {
+		return nil, err
+	}
+
+	b, err := tx.tx.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeRedis(b)
+}
+
+func (tx *redisTx) Set(key string, val interface{}, ttl ...int) error {
+	w := &txWrite{val: val}
+	if len(ttl) > 0 {
+		w.ttl = ttl[0]
+	}
+	tx.writes[key] = w
+	return nil
+}
+
+func (tx *redisTx) Delete(key string) error {
+	tx.writes[key] = &txWrite{}
+	return nil
+}
+
+func (tx *redisTx) Keys(prefix string) ([]string, error) {
+	stored, err := tx.c.Keys(tx.ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, k := range stored {
+		if _, ok := tx.writes[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	for k, w := range tx.writes {
+		if w.val != nil && strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (tx *redisTx) commit() error {
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	_, err := tx.tx.Pipelined(func(p redis.Pipeliner) error {
+		for k, w := range tx.writes {
+			if w.val == nil {
+				p.Del(k)
+				continue
+			}
+
+			b, err := encode(w.val)
+			if err != nil {
+				return err
+			}
+			var exp time.Duration
+			if w.ttl > 0 {
+				exp = time.Duration(w.ttl) * time.Second
+			}
+			p.Set(k, b, exp)
+		}
+		return nil
+	})
+	return err
+}
+
+// decodeRedis decodes value, or counter of Inc.
+func decodeRedis(b []byte) (interface{}, error) {
+	v, err := decode(b)
+	if err != nil {
+		if n, nerr := strconv.Atoi(string(b)); nerr == nil {
+			return n, nil
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
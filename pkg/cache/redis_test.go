@@ -0,0 +1,99 @@
+package cache_test
+
+import (
+	"context"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+	"github.com/alicebob/miniredis"
+)
+
+type value struct {
+	ID  string
+	IPs []string
+}
+
+func init() {
+	gob.Register(&value{})
+}
+
+func TestRedis(t *testing.T) {
+	ctx := context.Background()
+
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	c := cache.NewRedis(m.Addr(), "", 0)
+	defer c.Close()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		val  interface{}
+	}{
+		{name: "TestRedisStruct", key: "wgclient:1", val: &value{ID: "1", IPs: []string{"10.0.0.2"}}},
+		{name: "TestRedisBool", key: "ip:reserved:10.0.0.2", val: true},
+		{name: "TestRedisTime", key: "wgserver:1:heartbeat", val: time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.Set(ctx, tt.key, tt.val); err != nil {
+				t.Fatalf("Redis.Set() error = %v", err)
+			}
+
+			got, err := c.Get(ctx, tt.key)
+			if err != nil || !reflect.DeepEqual(got, tt.val) {
+				t.Errorf("Redis.Get() = %#v, %v, want %#v", got, err, tt.val)
+			}
+
+			got, err = c.Delete(ctx, tt.key)
+			if err != nil || !reflect.DeepEqual(got, tt.val) {
+				t.Errorf("Redis.Delete() = %#v, %v, want %#v", got, err, tt.val)
+			}
+			if got, _ := c.Get(ctx, tt.key); got != nil {
+				t.Errorf("Redis.Get() after delete = %#v", got)
+			}
+		})
+	}
+
+	t.Run("TestRedisTTL", func(t *testing.T) {
+		c.Set(ctx, "alive", true, 10)
+		m.FastForward(11 * time.Second)
+
+		if got, _ := c.Get(ctx, "alive"); got != nil {
+			t.Errorf("Redis.Get() after ttl = %#v", got)
+		}
+	})
+
+	t.Run("TestRedisInc", func(t *testing.T) {
+		for want := 1; want <= 3; want++ {
+			if got, err := c.Inc(ctx, "iterator"); err != nil || got != want {
+				t.Errorf("Redis.Inc() = %d, %v, want %d", got, err, want)
+			}
+		}
+		if got, _ := c.Get(ctx, "iterator"); got != 3 {
+			t.Errorf("Redis.Get() of counter = %#v, want 3", got)
+		}
+	})
+
+	t.Run("TestRedisKeys", func(t *testing.T) {
+		for _, k := range []string{"wgclient:b", "wgclient:a", "pubkey:wgclient:a", "wgclient*"} {
+			c.Set(ctx, k, true)
+		}
+
+		got, err := c.Keys(ctx, "wgclient:")
+		if want := []string{"wgclient:a", "wgclient:b"}; err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Redis.Keys() = %v, %v, want %v", got, err, want)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const snapshotVersion = 1
+
+// snapshot is how Map is kept on disk, gob keeps concrete types of values.
+type snapshot struct {
+	Version int
+	Entries map[string]snapshotEntry
+}
+
+type snapshotEntry struct {
+	V   interface{}
+	Exp time.Time
+}
+
+// Snapshot writes keys of map with their ttl to w.
+// Types stored as values must be registered with gob.Register by their package.
+func (c *Map) Snapshot(w io.Writer) error {
+	c.RLock()
+	now := time.Now()
+	s := snapshot{Version: snapshotVersion, Entries: make(map[string]snapshotEntry, len(c.c))}
+	for k, v := range c.c {
+		if !c.expired(k, now) {
+			s.Entries[k] = snapshotEntry{V: v, Exp: c.exp[k]}
+		}
+	}
+	c.RUnlock()
+
+	if err := gob.NewEncoder(w).Encode(&s); err != nil {
+		return fmt.Errorf("snapshot:encode:%v", err)
+	}
+	return nil
+}
+
+// Restore replaces keys of map with a snapshot of r, keys expired meanwhile are dropped.
+func (c *Map) Restore(r io.Reader) error {
+	var s snapshot
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return fmt.Errorf("snapshot:decode:%v", err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("snapshot:version %d is not supported", s.Version)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	c.c = make(map[string]interface{}, len(s.Entries))
+	c.exp = make(map[string]time.Time)
+	for k, e := range s.Entries {
+		if !e.Exp.IsZero() {
+			if !now.Before(e.Exp) {
+				continue
+			}
+			c.exp[k] = e.Exp
+		}
+		c.c[k] = e.V
+	}
+	return nil
+}
+
+// SaveFile writes snapshot of map to path.
+// It is written to a temporary file first and renamed, so path always has a complete snapshot.
+func (c *Map) SaveFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("snapshot:%v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := c.Snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("snapshot:%v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("snapshot:%v", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("snapshot:%v", err)
+	}
+	return nil
+}
+
+// LoadFile restores map from snapshot at path, a missing file leaves map as is.
+func (c *Map) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("snapshot:%v", err)
+	}
+	defer f.Close()
+
+	return c.Restore(f)
+}
@@ -0,0 +1,75 @@
+package cache_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+)
+
+func TestMap_SaveFile(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "map.snapshot")
+
+	// missing snapshot is an empty map.
+	if err := cache.NewMap().LoadFile(path); err != nil {
+		t.Fatalf("Map.LoadFile() missing file error = %v", err)
+	}
+
+	c := cache.NewMap()
+	c.Set(ctx, "wgclient:1", &value{ID: "1", IPs: []string{"10.0.0.2"}})
+	c.Set(ctx, "ip:reserved:10.0.0.2", true)
+	c.Set(ctx, "ip:pool:released:10.0.0.3", time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC))
+	c.Set(ctx, "wgserver:1:alive", true, 3600)
+	c.Set(ctx, "expired", true, 1)
+	c.Inc(ctx, "ip:pool:iterator")
+	c.Inc(ctx, "ip:pool:iterator")
+
+	time.Sleep(1100 * time.Millisecond)
+	if err := c.SaveFile(path); err != nil {
+		t.Fatalf("Map.SaveFile() error = %v", err)
+	}
+
+	got := cache.NewMap()
+	got.Set(ctx, "stale", true)
+	if err := got.LoadFile(path); err != nil {
+		t.Fatalf("Map.LoadFile() error = %v", err)
+	}
+
+	if got.String() != c.String() {
+		t.Errorf("Map.LoadFile() = %s, want %s", got.String(), c.String())
+	}
+	if v, _ := got.Get(ctx, "wgclient:1"); !reflect.DeepEqual(v, &value{ID: "1", IPs: []string{"10.0.0.2"}}) {
+		t.Errorf("Map.Get() = %#v, want typed value", v)
+	}
+	if n, _ := got.Inc(ctx, "ip:pool:iterator"); n != 3 {
+		t.Errorf("Map.Inc() = %d, want 3", n)
+	}
+
+	// ttl is kept.
+	var expired []string
+	got.OnExpire("", func(key string, val interface{}) { expired = append(expired, key) })
+	got.Set(ctx, "wgserver:2:alive", true, 1)
+	if err := got.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := got.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	got.DeleteExpired()
+	if !reflect.DeepEqual(expired, []string{"wgserver:2:alive"}) {
+		t.Errorf("Map.LoadFile() expired keys = %v, want [wgserver:2:alive]", expired)
+	}
+}
@@ -2,8 +2,13 @@ package ip
 
 import (
 	"context"
+	"encoding/gob"
 	"fmt"
+	"math/big"
+	"net"
+	"time"
 
+	"bitbucket.org/qubole/wireguard/pkg/cache"
 	"inet.af/netaddr"
 )
 
@@ -14,44 +19,471 @@ var (
 	cgNAT         = mustCIDR("100.64.0.0/10")
 	linkLocalIPv4 = mustCIDR("169.254.0.0/16")
 	v6Global1     = mustCIDR("2000::/3")
+	v6ULA         = mustCIDR("fc00::/7")
+
+	// pools can only be carved out of these.
+	allowedPools = []netaddr.IPPrefix{private1, private2, private3, cgNAT, linkLocalIPv4, v6ULA, v6Global1}
 )
 
+func init() {
+	gob.Register(&Released{})
+}
+
+// ExhaustedError means pool has no free IP left.
+type ExhaustedError struct {
+	Pool string
+}
+
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("ip pool %s exhausted", e.Pool)
+}
+
+// ConflictError means IP to reserve is already allocated, reserved or in quarantine.
+type ConflictError struct {
+	IP string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("ip %s already in use", e.IP)
+}
+
+// Released IPs of a pool in order of release, Get reuses them first once their quarantine is over.
+type Released struct {
+	IPs []ReleasedIP `json:"ips"`
+}
+
+// ReleasedIP is an IP released at At.
+type ReleasedIP struct {
+	IP string    `json:"ip"`
+	At time.Time `json:"at"`
+}
+
 // Store interface.
 type Store interface {
-	Inc(context.Context, string) (int, error)
+	Set(context.Context, string, interface{}, ...int) error
+	Update(context.Context, func(cache.Tx) error) error
 }
 
-// Svc struct.
+// Svc allocates IPs from a pool.
 type Svc struct {
-	store Store
+	store    Store
+	pool     netaddr.IPPrefix
+	base     *big.Int // network address
+	size     *big.Int // number of addresses in pool
+	capacity *big.Int // number of allocatable addresses, i.e. usable ones which are not reserved
+	ipLen    int      // 4 or 16
+	reserved map[string]struct{}
+
+	quarantine time.Duration
 }
 
-// NewSvc is constructor.
-func NewSvc(store Store) *Svc {
-	return &Svc{store: store}
+// NewSvc is constructor. Reserved IPs (e.g. of wgserver) are never allocated.
+func NewSvc(store Store, pool netaddr.IPPrefix, reserved ...string) (*Svc, error) {
+	if !allowed(pool) {
+		return nil, fmt.Errorf("ip pool %s is neither private nor ipv6 global unicast", pool)
+	}
+
+	_, n, err := net.ParseCIDR(pool.String())
+	if err != nil {
+		return nil, err
+	}
+	ipLen := net.IPv4len
+	if n.IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+	ones, bits := n.Mask.Size()
+
+	s := &Svc{
+		store:    store,
+		pool:     pool,
+		base:     new(big.Int).SetBytes(n.IP),
+		size:     new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)),
+		ipLen:    ipLen,
+		reserved: map[string]struct{}{},
+	}
+
+	for _, r := range reserved {
+		ip, err := netaddr.ParseIP(r)
+		if err != nil {
+			return nil, fmt.Errorf("reserved ip %q: %v", r, err)
+		}
+		if !pool.Contains(ip) {
+			return nil, fmt.Errorf("reserved ip %s not in pool %s", r, pool)
+		}
+		s.reserved[ip.String()] = struct{}{}
+	}
+
+	first, last := s.usable()
+	s.capacity = new(big.Int).Sub(last, first)
+	s.capacity.Add(s.capacity, big.NewInt(1))
+	for r := range s.reserved {
+		if s.usableIP(r) {
+			s.capacity.Sub(s.capacity, big.NewInt(1))
+		}
+	}
+
+	return s, nil
 }
 
-// Get IP.
+// Pool returns the pool IPs are allocated from.
+func (i *Svc) Pool() netaddr.IPPrefix {
+	return i.pool
+}
+
+// SetQuarantine sets how long a released IP is kept before reuse,
+// so that stale peers still routing it have gone away.
+func (i *Svc) SetQuarantine(d time.Duration) {
+	i.quarantine = d
+}
+
+// Get allocates an IP of pool, released IPs past quarantine are reused first.
+// Network, broadcast and reserved IPs are skipped, *ExhaustedError is returned when pool is full.
 func (i *Svc) Get(ctx context.Context) (string, error) {
-	iter, err := i.store.Inc(ctx, "ip-iterator")
+	var ip string
+	err := i.store.Update(ctx, func(tx cache.Tx) error {
+		var err error
+		ip, err = i.GetTx(tx)
+		return err
+	})
+	return ip, err
+}
+
+// GetTx is Get within tx, a transaction of the store of Svc. IP is allocated only if tx commits.
+// IPs which were ever allocated or reserved are counted, so a full pool fails without a scan.
+func (i *Svc) GetTx(tx cache.Tx) (string, error) {
+	ip, err := i.reuse(tx)
+	if err != nil || ip != "" {
+		return ip, err
+	}
+
+	used, err := i.used(tx)
+	if err != nil {
+		return "", err
+	}
+	if big.NewInt(int64(used)).Cmp(i.capacity) >= 0 {
+		return "", &ExhaustedError{Pool: i.pool.String()}
+	}
+
+	first, last := i.usable()
+	usable := new(big.Int).Sub(last, first)
+	usable.Add(usable, big.NewInt(1))
+
+	v, err := tx.Get(i.iteratorKey())
+	if err != nil {
+		return "", err
+	}
+	iter, _ := v.(int)
+
+	for n := big.NewInt(0); n.Cmp(usable) < 0; n.Add(n, big.NewInt(1)) {
+		iter++
+
+		// iterator starts at 1, offset = first + (iter-1) % usable
+		off := new(big.Int).Mod(big.NewInt(int64(iter-1)), usable)
+		off.Add(off, first)
+		ip := i.ip(off)
+
+		free, err := i.free(tx, ip)
+		if err != nil {
+			return "", err
+		}
+		if !free {
+			continue
+		}
+
+		if err := tx.Set(i.iteratorKey(), iter); err != nil {
+			return "", err
+		}
+		return ip, i.allocate(tx, ip)
+	}
+
+	return "", &ExhaustedError{Pool: i.pool.String()}
+}
+
+// Reserve IP so that Get never returns it, e.g. IPs of imported peers.
+// *ConflictError is returned if it is already allocated, reserved or in quarantine.
+// Reserved IPs of Svc may be reserved, they are kept for servers.
+func (i *Svc) Reserve(ctx context.Context, ip string) error {
+	return i.store.Update(ctx, func(tx cache.Tx) error {
+		return i.ReserveTx(tx, ip)
+	})
+}
+
+// ReserveTx is Reserve within tx of store.
+func (i *Svc) ReserveTx(tx cache.Tx, ip string) error {
+	parsed, err := netaddr.ParseIP(ip)
+	if err != nil {
+		return err
+	}
+	ip = parsed.String()
+
+	free, err := i.unused(tx, ip)
+	if err != nil {
+		return err
+	}
+	if !free {
+		return &ConflictError{IP: ip}
+	}
+
+	if err := i.count(tx, ip); err != nil {
+		return err
+	}
+	if err := tx.Set(i.reservedKey(ip), true); err != nil {
+		return err
+	}
+	return tx.Delete(i.releasedKey(ip))
+}
+
+// Release frees an allocated or reserved IP, Get hands it out again once quarantine is over.
+// IPs outside of pool are only unreserved.
+func (i *Svc) Release(ctx context.Context, ip string) error {
+	return i.store.Update(ctx, func(tx cache.Tx) error {
+		return i.ReleaseTx(tx, ip)
+	})
+}
+
+// ReleaseTx is Release within tx of store.
+func (i *Svc) ReleaseTx(tx cache.Tx, ip string) error {
+	parsed, err := netaddr.ParseIP(ip)
+	if err != nil {
+		return err
+	}
+	ip = parsed.String()
+
+	held := false
+	for _, k := range []string{i.allocatedKey(ip), i.reservedKey(ip)} {
+		v, err := tx.Get(k)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			continue
+		}
+		held = true
+		if err := tx.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	if !held || !i.usableIP(ip) {
+		return nil
+	}
+	if _, ok := i.reserved[ip]; ok {
+		return nil
+	}
+
+	now := time.Now()
+	rl, err := i.released(tx)
 	if err != nil {
+		return err
+	}
+	ips := append(append([]ReleasedIP{}, rl.IPs...), ReleasedIP{IP: ip, At: now})
+	if err := tx.Set(i.releasedListKey(), &Released{IPs: ips}); err != nil {
+		return err
+	}
+	return tx.Set(i.releasedKey(ip), now)
+}
+
+// reuse allocates the oldest released IP if its quarantine is over. Entries of IPs
+// which were allocated, reserved or released again meanwhile are dropped.
+func (i *Svc) reuse(tx cache.Tx) (string, error) {
+	rl, err := i.released(tx)
+	if err != nil || len(rl.IPs) == 0 {
 		return "", err
 	}
 
-	if iter > int(255*255*255) {
-		return "", fmt.Errorf("ip address overflowed")
+	var ip string
+	ips := rl.IPs
+	for ip == "" && len(ips) > 0 {
+		head := ips[0]
+
+		v, err := tx.Get(i.releasedKey(head.IP))
+		if err != nil {
+			return "", err
+		}
+		if at, ok := v.(time.Time); ok && at.Equal(head.At) {
+			if time.Now().Before(head.At.Add(i.quarantine)) {
+				break
+			}
+
+			free, err := i.free(tx, head.IP)
+			if err != nil {
+				return "", err
+			}
+			if free {
+				ip = head.IP
+			}
+		}
+		ips = ips[1:]
+	}
+
+	if len(ips) != len(rl.IPs) {
+		if err := tx.Set(i.releasedListKey(), &Released{IPs: append([]ReleasedIP{}, ips...)}); err != nil {
+			return "", err
+		}
+	}
+	if ip == "" {
+		return "", nil
+	}
+	return ip, i.allocate(tx, ip)
+}
+
+func (i *Svc) released(tx cache.Tx) (*Released, error) {
+	v, err := tx.Get(i.releasedListKey())
+	if err != nil {
+		return nil, err
+	}
+	if rl, ok := v.(*Released); ok {
+		return rl, nil
 	}
+	return &Released{}, nil
+}
+
+func (i *Svc) allocate(tx cache.Tx, ip string) error {
+	if err := i.count(tx, ip); err != nil {
+		return err
+	}
+
+	err := tx.Set(i.allocatedKey(ip), true)
+	if err != nil {
+		return err
+	}
+
+	return tx.Delete(i.releasedKey(ip))
+}
+
+// count ip as used, unless it was already, i.e. it is released, or it is no allocatable IP of pool.
+func (i *Svc) count(tx cache.Tx, ip string) error {
+	if _, ok := i.reserved[ip]; ok || !i.usableIP(ip) {
+		return nil
+	}
+
+	v, err := tx.Get(i.releasedKey(ip))
+	if err != nil || v != nil {
+		return err
+	}
+
+	used, err := i.used(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Set(i.usedKey(), used+1)
+}
+
+// used is number of allocatable IPs of pool which were ever allocated or reserved.
+func (i *Svc) used(tx cache.Tx) (int, error) {
+	v, err := tx.Get(i.usedKey())
+	if err != nil {
+		return 0, err
+	}
+	used, _ := v.(int)
+	return used, nil
+}
+
+// free tells if ip is neither reserved, allocated nor in quarantine.
+func (i *Svc) free(tx cache.Tx, ip string) (bool, error) {
+	if _, ok := i.reserved[ip]; ok {
+		return false, nil
+	}
+	return i.unused(tx, ip)
+}
+
+// unused tells if ip is neither reserved nor allocated in store, nor in quarantine.
+func (i *Svc) unused(tx cache.Tx, ip string) (bool, error) {
+	v, err := tx.Get(i.releasedKey(ip))
+	if err != nil {
+		return false, err
+	}
+	if at, ok := v.(time.Time); ok && time.Now().Before(at.Add(i.quarantine)) {
+		return false, nil
+	}
+
+	for _, k := range []string{i.reservedKey(ip), i.allocatedKey(ip)} {
+		v, err := tx.Get(k)
+		if err != nil {
+			return false, err
+		}
+		if v != nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// usable returns first and last allocatable offsets in pool.
+func (i *Svc) usable() (*big.Int, *big.Int) {
+	last := new(big.Int).Sub(i.size, big.NewInt(1))
+
+	// /31, /32 and /127, /128 have no network or broadcast address.
+	if i.size.Cmp(big.NewInt(2)) <= 0 {
+		return big.NewInt(0), last
+	}
+
+	// skip network address, and broadcast for ipv4.
+	if i.ipLen == net.IPv4len {
+		last.Sub(last, big.NewInt(1))
+	}
+	return big.NewInt(1), last
+}
+
+// usableIP tells if ip is an allocatable address of pool, i.e. in pool and not its network or broadcast.
+func (i *Svc) usableIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	if i.ipLen == net.IPv4len {
+		parsed = parsed.To4()
+	}
+	if len(parsed) != i.ipLen {
+		return false
+	}
+
+	off := new(big.Int).Sub(new(big.Int).SetBytes(parsed), i.base)
+	first, last := i.usable()
+	return off.Cmp(first) >= 0 && off.Cmp(last) <= 0
+}
+
+func (i *Svc) ip(offset *big.Int) string {
+	b := new(big.Int).Add(i.base, offset).Bytes()
+
+	ip := make(net.IP, i.ipLen)
+	copy(ip[i.ipLen-len(b):], b)
+
+	return ip.String()
+}
+
+func (i *Svc) iteratorKey() string {
+	return fmt.Sprintf("ip:%s:iterator", i.pool)
+}
+
+func (i *Svc) allocatedKey(ip string) string {
+	return fmt.Sprintf("ip:allocated:%s", ip)
+}
+
+func (i *Svc) reservedKey(ip string) string {
+	return fmt.Sprintf("ip:reserved:%s", ip)
+}
+
+func (i *Svc) releasedKey(ip string) string {
+	return fmt.Sprintf("ip:%s:released:%s", i.pool, ip)
+}
+
+func (i *Svc) releasedListKey() string {
+	return fmt.Sprintf("ip:%s:released", i.pool)
+}
+
+func (i *Svc) usedKey() string {
+	return fmt.Sprintf("ip:%s:used", i.pool)
+}
 
-	arr := []int{0, 0, 0}
-	for i := 2; i >= 0; i-- {
-		arr[i] = iter & 255
-		iter = iter >> 8
-		if iter == 0 {
-			break
+// allowed tells if pool is inside one of private ranges.
+func allowed(pool netaddr.IPPrefix) bool {
+	for _, p := range allowedPools {
+		if p.Contains(pool.IP) && p.Bits <= pool.Bits {
+			return true
 		}
 	}
-	// overflow at 255
-	return fmt.Sprintf("10.%d.%d.%d", arr[0], arr[1], arr[2]), nil
+	return false
 }
 
 func mustCIDR(s string) netaddr.IPPrefix {
@@ -0,0 +1,338 @@
+package ip_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+	"bitbucket.org/qubole/wireguard/pkg/ip"
+	"inet.af/netaddr"
+)
+
+func TestNewSvc(t *testing.T) {
+	tests := []struct {
+		name     string
+		pool     string
+		reserved []string
+		wantErr  bool
+	}{
+		{name: "TestNewSvcPrivate", pool: "10.33.0.0/24", reserved: []string{"10.33.0.1"}},
+		{name: "TestNewSvcCGNAT", pool: "100.64.0.0/16"},
+		{name: "TestNewSvcULA", pool: "fd00:33::/64", reserved: []string{"fd00:33::1"}},
+		{name: "TestNewSvcGlobalIPv6", pool: "2001:db8::/64"},
+		{name: "TestNewSvcMulticastIPv6", pool: "ff00::/64", wantErr: true},
+		{name: "TestNewSvcPublic", pool: "8.8.8.0/24", wantErr: true},
+		{name: "TestNewSvcWiderThanPrivate", pool: "10.0.0.0/7", wantErr: true},
+		{name: "TestNewSvcReservedOutsidePool", pool: "10.33.0.0/24", reserved: []string{"10.34.0.1"}, wantErr: true},
+		{name: "TestNewSvcReservedInvalid", pool: "10.33.0.0/24", reserved: []string{"10.33.0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ip.NewSvc(cache.NewMap(), mustPrefix(t, tt.pool), tt.reserved...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewSvc() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSvc_Get(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		pool     string
+		reserved []string
+		stored   []string // reserved through Reserve
+		want     []string
+	}{
+		{
+			name:     "TestGetSkipsNetworkBroadcastReserved",
+			pool:     "10.33.0.0/29",
+			reserved: []string{"10.33.0.1"},
+			stored:   []string{"10.33.0.4"},
+			want:     []string{"10.33.0.2", "10.33.0.3", "10.33.0.5", "10.33.0.6"},
+		},
+		{
+			name:     "TestGetIPv6KeepsLastAddress",
+			pool:     "fd00:33::/126",
+			reserved: []string{"fd00:33::1"},
+			want:     []string{"fd00:33::2", "fd00:33::3"},
+		},
+		{
+			name: "TestGetPointToPoint",
+			pool: "192.168.1.0/31",
+			want: []string{"192.168.1.0", "192.168.1.1"},
+		},
+		{
+			name: "TestGetSingleHost",
+			pool: "172.16.0.7/32",
+			want: []string{"172.16.0.7"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ip.NewSvc(cache.NewMap(), mustPrefix(t, tt.pool), tt.reserved...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range tt.stored {
+				if err := s.Reserve(ctx, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := []string{}
+			for {
+				addr, err := s.Get(ctx)
+				if err != nil {
+					if _, ok := err.(*ip.ExhaustedError); !ok {
+						t.Fatalf("Svc.Get() error = %v, want *ExhaustedError", err)
+					}
+					break
+				}
+				got = append(got, addr)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Svc.Get() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSvc_GetStaysInPool(t *testing.T) {
+	ctx := context.Background()
+	pool := mustPrefix(t, "10.33.0.0/24")
+
+	s, err := ip.NewSvc(cache.NewMap(), pool, "10.33.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 253; i++ {
+		addr, err := s.Get(ctx)
+		if err != nil {
+			t.Fatalf("Svc.Get() #%d error = %v", i, err)
+		}
+
+		parsed, err := netaddr.ParseIP(addr)
+		if err != nil || !pool.Contains(parsed) {
+			t.Fatalf("Svc.Get() = %s, not in pool %s", addr, pool)
+		}
+		if seen[addr] || addr == "10.33.0.0" || addr == "10.33.0.1" || addr == "10.33.0.255" {
+			t.Fatalf("Svc.Get() = %s, not allocatable", addr)
+		}
+		seen[addr] = true
+	}
+
+	if _, err := s.Get(ctx); err == nil {
+		t.Errorf("Svc.Get() on full pool returned no error")
+	}
+}
+
+func TestSvc_Release(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		quarantine time.Duration
+		sleep      time.Duration
+		release    string
+		want       string
+		wantErr    bool
+	}{
+		{name: "TestReleaseReuse", release: "10.33.0.2", want: "10.33.0.2"},
+		{name: "TestReleaseQuarantined", quarantine: time.Hour, release: "10.33.0.2", wantErr: true},
+		{name: "TestReleaseQuarantineOver", quarantine: 10 * time.Millisecond, sleep: 20 * time.Millisecond, release: "10.33.0.1", want: "10.33.0.1"},
+		{name: "TestReleaseOutsidePool", release: "10.34.0.2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// .1 and .2 usable
+			s, err := ip.NewSvc(cache.NewMap(), mustPrefix(t, "10.33.0.0/30"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.SetQuarantine(tt.quarantine)
+
+			for i := 0; i < 2; i++ {
+				if _, err := s.Get(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Release(ctx, tt.release); err != nil {
+				t.Fatalf("Svc.Release() error = %v", err)
+			}
+			time.Sleep(tt.sleep)
+
+			got, err := s.Get(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Svc.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Svc.Get() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// countingStore counts reads and key scans of transactions.
+type countingStore struct {
+	*cache.Map
+	gets, scans int
+}
+
+func (c *countingStore) Update(ctx context.Context, fn func(cache.Tx) error) error {
+	return c.Map.Update(ctx, func(tx cache.Tx) error {
+		return fn(&countingTx{Tx: tx, c: c})
+	})
+}
+
+type countingTx struct {
+	cache.Tx
+	c *countingStore
+}
+
+func (tx *countingTx) Get(key string) (interface{}, error) {
+	tx.c.gets++
+	return tx.Tx.Get(key)
+}
+
+func (tx *countingTx) Keys(prefix string) ([]string, error) {
+	tx.c.scans++
+	return tx.Tx.Keys(prefix)
+}
+
+func TestSvc_GetFreeList(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{Map: cache.NewMap()}
+
+	// a /8 pool would take millions of reads to find out it is full by a scan.
+	s, err := ip.NewSvc(store, mustPrefix(t, "10.33.0.0/29"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if _, err := s.Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store.gets = 0
+	if _, err := s.Get(ctx); err == nil {
+		t.Fatalf("Svc.Get() on full pool error = nil")
+	}
+	if store.gets > 4 {
+		t.Errorf("Svc.Get() on full pool read %d keys, want it to fail fast", store.gets)
+	}
+
+	// released ips are reused in order of release.
+	for _, r := range []string{"10.33.0.5", "10.33.0.2", "10.33.0.3"} {
+		if err := s.Release(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Release(ctx, "10.33.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for i := 0; i < 3; i++ {
+		addr, err := s.Get(ctx)
+		if err != nil {
+			t.Fatalf("Svc.Get() error = %v", err)
+		}
+		got = append(got, addr)
+	}
+	if want := []string{"10.33.0.5", "10.33.0.2", "10.33.0.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Svc.Get() = %v, want %v", got, want)
+	}
+	if _, err := s.Get(ctx); err == nil {
+		t.Errorf("Svc.Get() on full pool error = nil")
+	}
+
+	if store.scans != 0 {
+		t.Errorf("Svc.Get() scanned keys %d times, want none", store.scans)
+	}
+}
+
+func TestSvc_Reserve(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name         string
+		reserve      string
+		wantConflict bool
+		wantErr      bool
+	}{
+		{name: "TestReserveFree", reserve: "10.33.0.3"},
+		{name: "TestReserveOutsidePool", reserve: "192.168.1.4"},
+		{name: "TestReserveStatic", reserve: "10.33.0.254"},
+		{name: "TestReserveAllocated", reserve: "10.33.0.1", wantConflict: true},
+		{name: "TestReserveReserved", reserve: "10.33.0.2", wantConflict: true},
+		{name: "TestReserveQuarantined", reserve: "10.33.0.4", wantConflict: true},
+		{name: "TestReserveInvalid", reserve: "10.33.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cache.NewMap()
+			s, err := ip.NewSvc(c, mustPrefix(t, "10.33.0.0/24"), "10.33.0.254")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.SetQuarantine(time.Hour)
+
+			// .1 allocated, .2 reserved, .4 released.
+			if got, err := s.Get(ctx); err != nil || got != "10.33.0.1" {
+				t.Fatalf("Svc.Get() = %v, %v", got, err)
+			}
+			for _, r := range []string{"10.33.0.2", "10.33.0.4"} {
+				if err := s.Reserve(ctx, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Release(ctx, "10.33.0.4"); err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.Reserve(ctx, tt.reserve)
+			_, conflict := err.(*ip.ConflictError)
+			if conflict != tt.wantConflict || (err != nil && !conflict) != tt.wantErr {
+				t.Fatalf("Svc.Reserve() error = %v, wantConflict %v, wantErr %v", err, tt.wantConflict, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if v, _ := c.Get(ctx, "ip:reserved:"+tt.reserve); v == nil {
+				t.Errorf("Svc.Reserve() did not reserve %s", tt.reserve)
+			}
+			if err := s.Reserve(ctx, tt.reserve); err == nil {
+				t.Errorf("Svc.Reserve() again error = nil, want conflict")
+			}
+		})
+	}
+
+	// ips are normalized, so another spelling of a reserved ip is in use.
+	v6, err := ip.NewSvc(cache.NewMap(), mustPrefix(t, "fd00:33::/64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v6.Reserve(ctx, "fd00:33:0:0::2"); err != nil {
+		t.Fatalf("Svc.Reserve() error = %v", err)
+	}
+	if err := v6.Reserve(ctx, "fd00:33::2"); err == nil {
+		t.Errorf("Svc.Reserve() other spelling error = nil, want conflict")
+	}
+}
+
+func mustPrefix(t *testing.T, s string) netaddr.IPPrefix {
+	p, err := netaddr.ParseIPPrefix(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
@@ -2,20 +2,52 @@ package wgclient
 
 import (
 	"context"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+	"bitbucket.org/qubole/wireguard/pkg/wgkey"
 	"bitbucket.org/qubole/wireguard/pkg/wgpeer"
 )
 
-// IPSvc to fetch IP.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ErrNotFound is returned for unknown wgclient.
+var ErrNotFound = errors.New("wgclient:not_found")
+
+// ValidationError means input is invalid, it is a bad request unlike store errors.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ":" + e.Reason
+}
+
+func init() {
+	// stored by value encoding stores.
+	gob.Register(&WGClient{})
+}
+
+// IPSvc to fetch IP within a transaction of Store, so IPs and clients are written together.
 type IPSvc interface {
-	Get(context.Context) (string, error)
+	GetTx(cache.Tx) (string, error)
+	ReserveTx(cache.Tx, string) error
+	ReleaseTx(cache.Tx, string) error
 }
 
-// Store interface.
+// Store interface, IPSvc must share it.
 type Store interface {
 	Get(context.Context, string) (interface{}, error)
-	Set(context.Context, string, interface{}, ...int) error
+	Keys(context.Context, string) ([]string, error)
+	Update(context.Context, func(cache.Tx) error) error
 }
 
 // WGServer interface.
@@ -25,17 +57,55 @@ type WGServer interface {
 }
 
 // WGClient info.
+// PresharedKey is a secret, only GenerateConfig returns it, Get, List, Update and Delete redact it.
 type WGClient struct {
-	ID         string   `json:"id,omitempty"`
-	PrivateIP  string   `json:"private_ip,omitempty"` // private key of client
-	PublicKey  string   `json:"public_key,omitempty"` // public key of client
-	DNSServers []string `json:"dns_servers,omitempty"`
+	ID           string   `json:"id,omitempty"`
+	PrivateIP    string   `json:"private_ip,omitempty"` // private ipv4 of client
+	PrivateIPv6  string   `json:"private_ipv6,omitempty"`
+	PublicKey    string   `json:"public_key,omitempty"` // public key of client
+	PresharedKey string   `json:"preshared_key,omitempty"`
+	DNSServers   []string `json:"dns_servers,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// ExpiresAt of ephemeral client, it is deleted with its IPs and peer once over.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired tells if client is ephemeral and over at now.
+func (c *WGClient) Expired(now time.Time) bool {
+	return c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
+
+// redacted copy of client without its preshared key.
+func (c *WGClient) redacted() *WGClient {
+	r := *c
+	r.PresharedKey = ""
+	return &r
+}
+
+// AllowedIPs returns single host cidrs of client IPs, i.e. what server routes to it.
+func (c *WGClient) AllowedIPs() []string {
+	ips := []string{}
+	for _, ip := range []string{c.PrivateIP, c.PrivateIPv6} {
+		switch {
+		case ip == "":
+		case strings.Contains(ip, "/"):
+			ips = append(ips, ip)
+		case strings.Contains(ip, ":"):
+			ips = append(ips, ip+"/128")
+		default:
+			ips = append(ips, ip+"/32")
+		}
+	}
+	return ips
 }
 
 // Svc struct.
 type Svc struct {
 	store    Store
 	ip       IPSvc
+	ipv6     IPSvc
 	wgServer WGServer
 }
 
@@ -44,70 +114,484 @@ func NewSvc(store Store, ip IPSvc, wgServer WGServer) *Svc {
 	return &Svc{store: store, ip: ip, wgServer: wgServer}
 }
 
+// SetIPv6 makes clients dual-stack, each new client also gets an IP of ipv6.
+func (s *Svc) SetIPv6(ipv6 IPSvc) {
+	s.ipv6 = ipv6
+}
+
 // Create wgclient.
 func (s *Svc) Create(ctx context.Context) error {
 	return nil
 }
 
 // GenerateConfigInput struct
+// PublicKey can be omitted to let server generate keypair of client.
+// TTL in seconds or ExpiresAt make an ephemeral client.
 type GenerateConfigInput struct {
-	ID        string `json:"id,omitempty"`
-	PublicKey string `json:"public_key,omitempty"`
+	ID                   string     `json:"id,omitempty"`
+	PublicKey            string     `json:"public_key,omitempty"`
+	GeneratePresharedKey bool       `json:"generate_preshared_key,omitempty"`
+	TTL                  int        `json:"ttl,omitempty"`
+	ExpiresAt            *time.Time `json:"expires_at,omitempty"`
+}
+
+// expiresAt of client of input at now, nil if it is not ephemeral.
+func (in *GenerateConfigInput) expiresAt(now time.Time) (*time.Time, error) {
+	switch {
+	case in.TTL != 0 && in.ExpiresAt != nil:
+		return nil, &ValidationError{Field: "expiry", Reason: "either ttl or expires_at"}
+	case in.TTL < 0:
+		return nil, &ValidationError{Field: "expiry", Reason: fmt.Sprintf("ttl %d is negative", in.TTL)}
+	case in.TTL > 0:
+		at := now.Add(time.Duration(in.TTL) * time.Second).UTC()
+		return &at, nil
+	case in.ExpiresAt != nil:
+		if !now.Before(*in.ExpiresAt) {
+			return nil, &ValidationError{Field: "expiry", Reason: fmt.Sprintf("expires_at %s is over", in.ExpiresAt.Format(time.RFC3339))}
+		}
+		at := in.ExpiresAt.UTC()
+		return &at, nil
+	}
+	return nil, nil
 }
 
 // GenerateConfigOutput needs to be returned to wgclient
+// PrivateKey is set only when server generated keypair of client, it is not stored anywhere.
 type GenerateConfigOutput struct {
 	Client            *WGClient       `json:"client,omitempty"`
+	PrivateKey        string          `json:"private_key,omitempty"`
 	SSHAuthorizedKeys []string        `json:"ssh_authorized_keys,omitempty"`
 	Peers             []wgpeer.WGPeer `json:"peers,omitempty"`
 }
 
 // GenerateConfig wgclient.
+// Client, its public key index and IPs are written in one transaction, so either all of
+// them are stored or none, and of concurrent requests with same public key only one succeeds.
+// An expired client of same id is replaced.
 func (s *Svc) GenerateConfig(ctx context.Context, in *GenerateConfigInput) (*GenerateConfigOutput, error) {
-	v, err := s.store.Get(ctx, s.key(in.ID))
+	if strings.TrimSpace(in.ID) == "" {
+		return nil, &ValidationError{Field: "id", Reason: "empty"}
+	}
+	if in.PublicKey != "" {
+		if err := wgkey.Validate(in.PublicKey); err != nil {
+			return nil, &ValidationError{Field: "publickey", Reason: err.Error()}
+		}
+	}
+
+	now := time.Now()
+	expiresAt, err := in.expiresAt(now)
 	if err != nil {
 		return nil, err
 	}
 
-	var client *WGClient
-	if v != nil {
-		c, ok := v.(*WGClient)
-		if !ok {
-			return nil, fmt.Errorf("store:invalid_client")
+	// keys are generated outside of transaction, it may be run more than once.
+	var (
+		publicKey    = in.PublicKey
+		privateKey   string
+		presharedKey string
+	)
+	if publicKey == "" {
+		kp, err := wgkey.GenerateKeyPair()
+		if err != nil {
+			return nil, fmt.Errorf("keypair:generate:%v", err)
+		}
+		publicKey, privateKey = kp.PublicKey, kp.PrivateKey
+	}
+	if in.GeneratePresharedKey {
+		presharedKey, err = wgkey.GeneratePresharedKey()
+		if err != nil {
+			return nil, fmt.Errorf("presharedkey:generate:%v", err)
 		}
+	}
 
-		client = c
-	} else {
-		pkey, err := s.store.Get(ctx, s.publicKey(in.PublicKey))
+	var (
+		client  *WGClient
+		created bool
+	)
+	err = s.store.Update(ctx, func(tx cache.Tx) error {
+		c, err := s.client(tx, s.key(in.ID))
 		if err != nil {
-			return nil, fmt.Errorf("publickey:get:%v", err)
+			return err
 		}
-		if pkey != nil {
-			return nil, fmt.Errorf("publickey:duplicate")
+		if c != nil && !c.Expired(now) {
+			client, created = c, false
+			return nil
+		}
+		if c != nil {
+			if err := s.remove(tx, c); err != nil {
+				return err
+			}
 		}
 
-		i, err := s.ip.Get(ctx)
+		dup, err := s.client(tx, s.publicKey(publicKey))
 		if err != nil {
-			return nil, fmt.Errorf("ip:get")
+			return fmt.Errorf("publickey:get:%v", err)
+		}
+		if dup != nil && !dup.Expired(now) {
+			return &ValidationError{Field: "publickey", Reason: "duplicate"}
+		}
+		if dup != nil {
+			if err := s.remove(tx, dup); err != nil {
+				return err
+			}
 		}
 
-		client = &WGClient{ID: in.ID, PublicKey: in.PublicKey, PrivateIP: i}
-		err = s.store.Set(ctx, s.key(in.ID), client)
+		c = &WGClient{ID: in.ID, PublicKey: publicKey, PresharedKey: presharedKey, ExpiresAt: expiresAt}
+		c.PrivateIP, err = s.ip.GetTx(tx)
 		if err != nil {
-			return nil, fmt.Errorf("store:set:wgclient:%v", err)
+			return fmt.Errorf("ip:get:%w", err)
+		}
+		if s.ipv6 != nil {
+			c.PrivateIPv6, err = s.ipv6.GetTx(tx)
+			if err != nil {
+				return fmt.Errorf("ipv6:get:%w", err)
+			}
 		}
 
-		err = s.store.Set(ctx, s.publicKey(in.PublicKey), client)
-		if err != nil {
-			return nil, fmt.Errorf("store:set:publickey:%v", err)
+		if err := s.put(tx, c); err != nil {
+			return err
 		}
+		client, created = c, true
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return &GenerateConfigOutput{
+	out := &GenerateConfigOutput{
 		Client:            client,
 		SSHAuthorizedKeys: s.wgServer.SSHAuthorizedKeys(ctx),
 		Peers:             s.wgServer.ServerPeers(ctx),
-	}, nil
+	}
+	if created {
+		out.PrivateKey = privateKey
+	}
+	return out, nil
+}
+
+// Import stores an existing client, e.g. a peer of wg-quick config, as is and reserves its IP.
+// Importing same client again is a no-op, an IP in use by another peer is *ip.ConflictError.
+func (s *Svc) Import(ctx context.Context, c *WGClient) error {
+	if err := wgkey.Validate(c.PublicKey); err != nil {
+		return &ValidationError{Field: "publickey", Reason: err.Error()}
+	}
+
+	return s.store.Update(ctx, func(tx cache.Tx) error {
+		var exists bool
+		for _, k := range []string{s.key(c.ID), s.publicKey(c.PublicKey)} {
+			old, err := s.client(tx, k)
+			if err != nil {
+				return err
+			}
+			if old != nil && (old.ID != c.ID || old.PublicKey != c.PublicKey) {
+				return fmt.Errorf("wgclient:duplicate:%s", k)
+			}
+			if old != nil {
+				exists = true
+			}
+		}
+		if exists {
+			return nil
+		}
+
+		err := s.ip.ReserveTx(tx, c.PrivateIP)
+		if err != nil {
+			return fmt.Errorf("ip:reserve:%w", err)
+		}
+
+		if c.PrivateIPv6 != "" && s.ipv6 != nil {
+			err = s.ipv6.ReserveTx(tx, c.PrivateIPv6)
+			if err != nil {
+				return fmt.Errorf("ipv6:reserve:%w", err)
+			}
+		}
+
+		return s.put(tx, c)
+	})
+}
+
+// Get returns wgclient of id, an expired client is not found.
+func (s *Svc) Get(ctx context.Context, id string) (*WGClient, error) {
+	v, err := s.store.Get(ctx, s.key(id))
+	if err != nil {
+		return nil, fmt.Errorf("store:get:%v", err)
+	}
+	if v == nil {
+		return nil, ErrNotFound
+	}
+
+	c, ok := v.(*WGClient)
+	if !ok {
+		return nil, fmt.Errorf("store:invalid_client")
+	}
+	if c.Expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return c.redacted(), nil
+}
+
+// ListInput struct
+// Clients are listed in order of id, After is id of last client of previous page.
+// Only clients having all of Labels are listed.
+type ListInput struct {
+	After  string            `json:"after,omitempty"`
+	Limit  int               `json:"limit,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// ListOutput struct
+// Next is After of next page, it is empty on last page.
+type ListOutput struct {
+	Clients []*WGClient `json:"clients"`
+	Next    string      `json:"next,omitempty"`
+}
+
+// List wgclients page by page.
+func (s *Svc) List(ctx context.Context, in *ListInput) (*ListOutput, error) {
+	limit := in.Limit
+	if limit <= 0 || limit > maxListLimit {
+		limit = defaultListLimit
+	}
+
+	keys, err := s.store.Keys(ctx, s.key(""))
+	if err != nil {
+		return nil, fmt.Errorf("store:keys:%v", err)
+	}
+
+	out := &ListOutput{Clients: []*WGClient{}}
+	for i, k := range keys {
+		if in.After != "" && k <= s.key(in.After) {
+			continue
+		}
+
+		c, err := s.Get(ctx, strings.TrimPrefix(k, s.key("")))
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !hasLabels(c, in.Labels) {
+			continue
+		}
+
+		out.Clients = append(out.Clients, c)
+		if len(out.Clients) == limit {
+			if i < len(keys)-1 {
+				out.Next = c.ID
+			}
+			break
+		}
+	}
+
+	return out, nil
+}
+
+// UpdateInput struct
+// Only set fields are updated. Labels are merged, a label with empty value is removed.
+// Key is rotated to PublicKey, or to a server generated keypair with RotateKey.
+type UpdateInput struct {
+	DNSServers []string          `json:"dns_servers,omitempty"`
+	PublicKey  string            `json:"public_key,omitempty"`
+	RotateKey  bool              `json:"rotate_key,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// UpdateOutput struct
+// PrivateKey is set only when server generated keypair of client, it is not stored anywhere.
+type UpdateOutput struct {
+	Client     *WGClient `json:"client,omitempty"`
+	PrivateKey string    `json:"private_key,omitempty"`
+}
+
+// Update wgclient of id, a key rotation moves its public key index too.
+func (s *Svc) Update(ctx context.Context, id string, in *UpdateInput) (*UpdateOutput, error) {
+	if in.PublicKey != "" && in.RotateKey {
+		return nil, &ValidationError{Field: "publickey", Reason: "rotate:either public_key or rotate_key"}
+	}
+	if in.PublicKey != "" {
+		if err := wgkey.Validate(in.PublicKey); err != nil {
+			return nil, &ValidationError{Field: "publickey", Reason: err.Error()}
+		}
+	}
+
+	// keypair is generated outside of transaction, it may be run more than once.
+	var privateKey, publicKey string
+	switch {
+	case in.RotateKey:
+		kp, err := wgkey.GenerateKeyPair()
+		if err != nil {
+			return nil, fmt.Errorf("keypair:generate:%v", err)
+		}
+		publicKey, privateKey = kp.PublicKey, kp.PrivateKey
+	case in.PublicKey != "":
+		publicKey = in.PublicKey
+	}
+
+	var out *UpdateOutput
+	err := s.store.Update(ctx, func(tx cache.Tx) error {
+		old, err := s.client(tx, s.key(id))
+		if err != nil {
+			return err
+		}
+		if old == nil || old.Expired(time.Now()) {
+			return ErrNotFound
+		}
+
+		// copy, stored client may be shared.
+		c := *old
+
+		if in.DNSServers != nil {
+			c.DNSServers = in.DNSServers
+		}
+
+		if len(in.Labels) > 0 {
+			c.Labels = make(map[string]string, len(old.Labels)+len(in.Labels))
+			for k, v := range old.Labels {
+				c.Labels[k] = v
+			}
+			for k, v := range in.Labels {
+				if v == "" {
+					delete(c.Labels, k)
+					continue
+				}
+				c.Labels[k] = v
+			}
+		}
+
+		if publicKey != "" && publicKey != old.PublicKey {
+			dup, err := s.client(tx, s.publicKey(publicKey))
+			if err != nil {
+				return fmt.Errorf("publickey:get:%v", err)
+			}
+			if dup != nil {
+				return &ValidationError{Field: "publickey", Reason: "duplicate"}
+			}
+
+			if err := tx.Delete(s.publicKey(old.PublicKey)); err != nil {
+				return fmt.Errorf("store:delete:publickey:%v", err)
+			}
+			c.PublicKey = publicKey
+		}
+
+		if err := s.put(tx, &c); err != nil {
+			return err
+		}
+		out = &UpdateOutput{Client: c.redacted(), PrivateKey: privateKey}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Delete removes wgclient and releases its IP.
+// Its peer is removed from wireguard servers on their next sync.
+func (s *Svc) Delete(ctx context.Context, id string) (*WGClient, error) {
+	var c *WGClient
+	err := s.store.Update(ctx, func(tx cache.Tx) error {
+		var err error
+		c, err = s.client(tx, s.key(id))
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			return ErrNotFound
+		}
+		return s.remove(tx, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.redacted(), nil
+}
+
+// CronExpire deletes expired clients with their IPs, their peers are removed from
+// wireguard servers on their next sync.
+func (s *Svc) CronExpire(ctx context.Context) error {
+	keys, err := s.store.Keys(ctx, s.key(""))
+	if err != nil {
+		return fmt.Errorf("store:keys:%v", err)
+	}
+
+	for _, k := range keys {
+		err := s.store.Update(ctx, func(tx cache.Tx) error {
+			c, err := s.client(tx, k)
+			if err != nil || c == nil || !c.Expired(time.Now()) {
+				return err
+			}
+			return s.remove(tx, c)
+		})
+		if err != nil {
+			return fmt.Errorf("wgclient:expire:%s:%v", k, err)
+		}
+	}
+	return nil
+}
+
+// remove client, its public key index and IPs within tx.
+func (s *Svc) remove(tx cache.Tx, c *WGClient) error {
+	for _, k := range []string{s.key(c.ID), s.publicKey(c.PublicKey)} {
+		if err := tx.Delete(k); err != nil {
+			return fmt.Errorf("store:delete:%v", err)
+		}
+	}
+
+	if c.PrivateIP != "" {
+		err := s.ip.ReleaseTx(tx, c.PrivateIP)
+		if err != nil {
+			return fmt.Errorf("ip:release:%v", err)
+		}
+	}
+
+	if c.PrivateIPv6 != "" && s.ipv6 != nil {
+		err := s.ipv6.ReleaseTx(tx, c.PrivateIPv6)
+		if err != nil {
+			return fmt.Errorf("ipv6:release:%v", err)
+		}
+	}
+	return nil
+}
+
+// client is typed record of key within tx, nil if there is none.
+func (s *Svc) client(tx cache.Tx, key string) (*WGClient, error) {
+	v, err := tx.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("store:get:%v", err)
+	}
+	if v == nil {
+		return nil, nil
+	}
+
+	c, ok := v.(*WGClient)
+	if !ok {
+		return nil, fmt.Errorf("store:invalid_client")
+	}
+	return c, nil
+}
+
+// put writes client and its public key index within tx.
+func (s *Svc) put(tx cache.Tx, c *WGClient) error {
+	err := tx.Set(s.key(c.ID), c)
+	if err != nil {
+		return fmt.Errorf("store:set:wgclient:%v", err)
+	}
+
+	err = tx.Set(s.publicKey(c.PublicKey), c)
+	if err != nil {
+		return fmt.Errorf("store:set:publickey:%v", err)
+	}
+	return nil
+}
+
+func hasLabels(c *WGClient, labels map[string]string) bool {
+	for k, v := range labels {
+		if c.Labels[k] != v {
+			return false
+		}
+	}
+	return true
 }
 
 func (s *Svc) key(id string) string {
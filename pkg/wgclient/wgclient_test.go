@@ -0,0 +1,558 @@
+package wgclient_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+	"bitbucket.org/qubole/wireguard/pkg/ip"
+	"bitbucket.org/qubole/wireguard/pkg/wgclient"
+	"bitbucket.org/qubole/wireguard/pkg/wgkey"
+	"bitbucket.org/qubole/wireguard/pkg/wgpeer"
+	"inet.af/netaddr"
+)
+
+type fakeIP struct {
+	n        int
+	format   string // defaults to 10.0.0.%d
+	released []string
+}
+
+func (f *fakeIP) GetTx(tx cache.Tx) (string, error) {
+	f.n++
+	if f.format == "" {
+		f.format = "10.0.0.%d"
+	}
+	return fmt.Sprintf(f.format, f.n+1), nil
+}
+
+func (f *fakeIP) ReserveTx(tx cache.Tx, ip string) error {
+	return nil
+}
+
+func (f *fakeIP) ReleaseTx(tx cache.Tx, ip string) error {
+	f.released = append(f.released, ip)
+	return nil
+}
+
+type fakeServer struct{}
+
+func (fakeServer) SSHAuthorizedKeys(ctx context.Context) []string {
+	return []string{"test"}
+}
+
+func (fakeServer) ServerPeers(ctx context.Context) []wgpeer.WGPeer {
+	return []wgpeer.WGPeer{{PublicKey: "4NkU0MYF3sdB28TL5qibSOA6aHMiHj/5MCQ8Qr87O3Y=", EndPoint: "1.1.1.1:51820"}}
+}
+
+func TestSvc_GenerateConfig(t *testing.T) {
+	ctx := context.Background()
+	pk := "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0="
+
+	tests := []struct {
+		name        string
+		in          *wgclient.GenerateConfigInput
+		wantPrivKey bool
+		wantPSK     bool
+		wantErr     bool
+	}{
+		{
+			name:    "TestGenerateConfigEmptyID",
+			in:      &wgclient.GenerateConfigInput{ID: " ", PublicKey: pk},
+			wantErr: true,
+		},
+		{
+			name:    "TestGenerateConfigInvalidKey",
+			in:      &wgclient.GenerateConfigInput{ID: "1", PublicKey: "dhfjdbfjdbffg"},
+			wantErr: true,
+		},
+		{
+			name: "TestGenerateConfigClientKey",
+			in:   &wgclient.GenerateConfigInput{ID: "1", PublicKey: pk},
+		},
+		{
+			name:        "TestGenerateConfigServerKey",
+			in:          &wgclient.GenerateConfigInput{ID: "1", GeneratePresharedKey: true},
+			wantPrivKey: true,
+			wantPSK:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cache.NewMap()
+			s := wgclient.NewSvc(c, &fakeIP{}, fakeServer{})
+
+			got, err := s.GenerateConfig(ctx, tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Svc.GenerateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if (got.PrivateKey != "") != tt.wantPrivKey {
+				t.Errorf("Svc.GenerateConfig() private key = %q, want %v", got.PrivateKey, tt.wantPrivKey)
+			}
+			if (got.Client.PresharedKey != "") != tt.wantPSK {
+				t.Errorf("Svc.GenerateConfig() preshared key = %q, want %v", got.Client.PresharedKey, tt.wantPSK)
+			}
+			if tt.wantPrivKey {
+				pub, err := wgkey.PublicKey(got.PrivateKey)
+				if err != nil || pub != got.Client.PublicKey {
+					t.Errorf("Svc.GenerateConfig() public key = %v, want %v", got.Client.PublicKey, pub)
+				}
+				if strings.Contains(c.String(), got.PrivateKey) {
+					t.Errorf("Svc.GenerateConfig() stored private key")
+				}
+			}
+
+			// same id returns stored client without private key.
+			again, err := s.GenerateConfig(ctx, &wgclient.GenerateConfigInput{ID: tt.in.ID, PublicKey: got.Client.PublicKey})
+			if err != nil || again.Client.PublicKey != got.Client.PublicKey || again.PrivateKey != "" {
+				t.Errorf("Svc.GenerateConfig() again = %+v, %v", again, err)
+			}
+			if again.Client.PresharedKey != got.Client.PresharedKey {
+				t.Errorf("Svc.GenerateConfig() again preshared key = %q, want %q", again.Client.PresharedKey, got.Client.PresharedKey)
+			}
+
+			// preshared key is a secret, only config has it.
+			if g, err := s.Get(ctx, tt.in.ID); err != nil || g.PresharedKey != "" {
+				t.Errorf("Svc.Get() = %+v, %v, want no preshared key", g, err)
+			}
+			if l, err := s.List(ctx, &wgclient.ListInput{}); err != nil || len(l.Clients) != 1 || l.Clients[0].PresharedKey != "" {
+				t.Errorf("Svc.List() = %+v, %v, want no preshared key", l, err)
+			}
+			if u, err := s.Update(ctx, tt.in.ID, &wgclient.UpdateInput{DNSServers: []string{"10.0.0.53"}}); err != nil || u.Client.PresharedKey != "" {
+				t.Errorf("Svc.Update() = %+v, %v, want no preshared key", u, err)
+			}
+			if d, err := s.Delete(ctx, tt.in.ID); err != nil || d.PresharedKey != "" {
+				t.Errorf("Svc.Delete() = %+v, %v, want no preshared key", d, err)
+			}
+		})
+	}
+}
+
+func TestSvc_GenerateConfigConcurrent(t *testing.T) {
+	ctx := context.Background()
+	pk := "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0="
+	pool, err := netaddr.ParseIPPrefix("10.33.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		ids   func(int) string
+		wantN int // successful requests
+	}{
+		{name: "TestGenerateConfigConcurrentDuplicateKey", ids: func(i int) string { return fmt.Sprint(i) }, wantN: 1},
+		{name: "TestGenerateConfigConcurrentSameID", ids: func(int) string { return "1" }, wantN: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cache.NewMap()
+			ips, err := ip.NewSvc(c, pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := wgclient.NewSvc(c, ips, fakeServer{})
+
+			var (
+				wg   sync.WaitGroup
+				mu   sync.Mutex
+				outs []*wgclient.GenerateConfigOutput
+			)
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(id string) {
+					defer wg.Done()
+
+					out, err := s.GenerateConfig(ctx, &wgclient.GenerateConfigInput{ID: id, PublicKey: pk})
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					outs = append(outs, out)
+					mu.Unlock()
+				}(tt.ids(i))
+			}
+			wg.Wait()
+
+			if len(outs) != tt.wantN {
+				t.Fatalf("Svc.GenerateConfig() succeeded %d times, want %d", len(outs), tt.wantN)
+			}
+			for _, out := range outs {
+				if !reflect.DeepEqual(out.Client, outs[0].Client) {
+					t.Errorf("Svc.GenerateConfig() = %+v, want %+v", out.Client, outs[0].Client)
+				}
+			}
+
+			// one client, its index and a single allocated ip, nothing orphaned.
+			for prefix, want := range map[string]int{"wgclient:": 1, "pubkey:wgclient:": 1, "ip:allocated:": 1} {
+				keys, err := c.Keys(ctx, prefix)
+				if err != nil || len(keys) != want {
+					t.Errorf("Keys(%q) = %v, %v, want %d keys", prefix, keys, err, want)
+				}
+			}
+			if keys, _ := c.Keys(ctx, "ip:allocated:"); len(keys) == 1 && keys[0] != "ip:allocated:"+outs[0].Client.PrivateIP {
+				t.Errorf("Keys() = %v, want ip of %+v", keys, outs[0].Client)
+			}
+		})
+	}
+}
+
+func TestSvc_GenerateConfigEphemeral(t *testing.T) {
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour).UTC()
+
+	tests := []struct {
+		name    string
+		in      *wgclient.GenerateConfigInput
+		want    time.Duration // expiry from now, 0 for a permanent client
+		wantAt  *time.Time
+		wantErr bool
+	}{
+		{name: "TestGenerateConfigPermanent", in: &wgclient.GenerateConfigInput{ID: "1"}},
+		{name: "TestGenerateConfigTTL", in: &wgclient.GenerateConfigInput{ID: "1", TTL: 600}, want: 10 * time.Minute},
+		{name: "TestGenerateConfigExpiresAt", in: &wgclient.GenerateConfigInput{ID: "1", ExpiresAt: &future}, wantAt: &future},
+		{name: "TestGenerateConfigExpiresAtOver", in: &wgclient.GenerateConfigInput{ID: "1", ExpiresAt: &past}, wantErr: true},
+		{name: "TestGenerateConfigNegativeTTL", in: &wgclient.GenerateConfigInput{ID: "1", TTL: -1}, wantErr: true},
+		{name: "TestGenerateConfigTTLAndExpiresAt", in: &wgclient.GenerateConfigInput{ID: "1", TTL: 1, ExpiresAt: &future}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := wgclient.NewSvc(cache.NewMap(), &fakeIP{}, fakeServer{})
+
+			got, err := s.GenerateConfig(ctx, tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Svc.GenerateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			at := got.Client.ExpiresAt
+			switch {
+			case tt.want == 0 && tt.wantAt == nil:
+				if at != nil {
+					t.Errorf("Svc.GenerateConfig() expires_at = %v, want none", at)
+				}
+			case tt.wantAt != nil:
+				if at == nil || !at.Equal(*tt.wantAt) {
+					t.Errorf("Svc.GenerateConfig() expires_at = %v, want %v", at, tt.wantAt)
+				}
+			default:
+				if at == nil || at.Sub(time.Now()) > tt.want || at.Sub(time.Now()) < tt.want-time.Minute {
+					t.Errorf("Svc.GenerateConfig() expires_at = %v, want in %v", at, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSvc_GenerateConfigExhausted(t *testing.T) {
+	ctx := context.Background()
+	pool, err := netaddr.ParseIPPrefix("10.33.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.NewMap()
+	ips, err := ip.NewSvc(c, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := wgclient.NewSvc(c, ips, fakeServer{})
+
+	for i := 0; i < 4; i++ {
+		_, err = s.GenerateConfig(ctx, &wgclient.GenerateConfigInput{ID: fmt.Sprint(i)})
+		if err != nil {
+			break
+		}
+	}
+
+	var exhausted *ip.ExhaustedError
+	if !errors.As(err, &exhausted) {
+		t.Errorf("Svc.GenerateConfig() error = %v, want *ip.ExhaustedError", err)
+	}
+}
+
+func TestSvc_Import(t *testing.T) {
+	ctx := context.Background()
+	pk := "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0="
+	other := "zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8="
+	pool, err := netaddr.ParseIPPrefix("10.33.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.NewMap()
+	ips, err := ip.NewSvc(c, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := wgclient.NewSvc(c, ips, fakeServer{})
+
+	laptop := &wgclient.WGClient{ID: "laptop", PublicKey: pk, PrivateIP: "10.33.0.2"}
+	if err := s.Import(ctx, laptop); err != nil {
+		t.Fatalf("Svc.Import() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		in      *wgclient.WGClient
+		wantErr bool
+	}{
+		{name: "TestImportAgain", in: &wgclient.WGClient{ID: "laptop", PublicKey: pk, PrivateIP: "10.33.0.2"}},
+		{name: "TestImportSameKeyOtherID", in: &wgclient.WGClient{ID: "phone", PublicKey: pk, PrivateIP: "10.33.0.3"}, wantErr: true},
+		{name: "TestImportSameIDOtherKey", in: &wgclient.WGClient{ID: "laptop", PublicKey: other, PrivateIP: "10.33.0.3"}, wantErr: true},
+		{name: "TestImportInvalidKey", in: &wgclient.WGClient{ID: "phone", PublicKey: "dhfjdbfjdbffg", PrivateIP: "10.33.0.3"}, wantErr: true},
+		{name: "TestImportIPInUse", in: &wgclient.WGClient{ID: "phone", PublicKey: other, PrivateIP: "10.33.0.2"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Import(ctx, tt.in); (err != nil) != tt.wantErr {
+				t.Errorf("Svc.Import() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	got, err := s.Get(ctx, "laptop")
+	if err != nil || got.PublicKey != pk || got.PrivateIP != "10.33.0.2" {
+		t.Errorf("Svc.Get() = %+v, %v, want imported client", got, err)
+	}
+	if _, err := s.Get(ctx, "phone"); err != wgclient.ErrNotFound {
+		t.Errorf("Svc.Get() error = %v, want %v", err, wgclient.ErrNotFound)
+	}
+
+	// ip of imported client is never allocated.
+	for n := 0; n < 10; n++ {
+		if got, err := ips.Get(ctx); err != nil || got == laptop.PrivateIP {
+			t.Fatalf("ip.Svc.Get() = %s, %v, want other than imported ip", got, err)
+		}
+	}
+}
+
+func TestSvc_CronExpire(t *testing.T) {
+	ctx := context.Background()
+	pk := "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0="
+
+	c := cache.NewMap()
+	ip := &fakeIP{}
+	s := wgclient.NewSvc(c, ip, fakeServer{})
+
+	eph, err := s.GenerateConfig(ctx, &wgclient.GenerateConfigInput{ID: "ci", PublicKey: pk, TTL: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GenerateConfig(ctx, &wgclient.GenerateConfigInput{ID: "dev"}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := s.Get(ctx, "ci"); err != wgclient.ErrNotFound {
+		t.Errorf("Svc.Get() of expired client error = %v, want %v", err, wgclient.ErrNotFound)
+	}
+
+	if err := s.CronExpire(ctx); err != nil {
+		t.Fatalf("Svc.CronExpire() error = %v", err)
+	}
+	if !reflect.DeepEqual(ip.released, []string{eph.Client.PrivateIP}) {
+		t.Errorf("Svc.CronExpire() released = %v, want [%s]", ip.released, eph.Client.PrivateIP)
+	}
+	if strings.Contains(c.String(), pk) || !strings.Contains(c.String(), "wgclient:dev") {
+		t.Errorf("Svc.CronExpire() store = %s", c.String())
+	}
+
+	// public key of expired client can be used again.
+	if _, err := s.GenerateConfig(ctx, &wgclient.GenerateConfigInput{ID: "ci2", PublicKey: pk}); err != nil {
+		t.Errorf("Svc.GenerateConfig() with key of expired client error = %v", err)
+	}
+}
+
+func TestSvc_GenerateConfigDualStack(t *testing.T) {
+	ctx := context.Background()
+
+	ipv6 := &fakeIP{format: "fd00::%d"}
+	s := wgclient.NewSvc(cache.NewMap(), &fakeIP{}, fakeServer{})
+	s.SetIPv6(ipv6)
+
+	got, err := s.GenerateConfig(ctx, &wgclient.GenerateConfigInput{ID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"10.0.0.2/32", "fd00::2/128"}
+	if !reflect.DeepEqual(got.Client.AllowedIPs(), want) {
+		t.Errorf("Svc.GenerateConfig() client ips = %v, want %v", got.Client.AllowedIPs(), want)
+	}
+
+	if _, err := s.Delete(ctx, "1"); err != nil || !reflect.DeepEqual(ipv6.released, []string{"fd00::2"}) {
+		t.Errorf("Svc.Delete() released ipv6 = %v, %v", ipv6.released, err)
+	}
+}
+
+func TestSvc_Delete(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		id      string
+		wantErr error
+	}{
+		{name: "TestDeleteSuccess", id: "1"},
+		{name: "TestDeleteNotFound", id: "2", wantErr: wgclient.ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cache.NewMap()
+			ip := &fakeIP{}
+			s := wgclient.NewSvc(c, ip, fakeServer{})
+
+			out, err := s.GenerateConfig(ctx, &wgclient.GenerateConfigInput{ID: "1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := s.Delete(ctx, tt.id)
+			if err != tt.wantErr {
+				t.Fatalf("Svc.Delete() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if got.PrivateIP != out.Client.PrivateIP || len(ip.released) != 1 || ip.released[0] != got.PrivateIP {
+				t.Errorf("Svc.Delete() released = %v, want [%s]", ip.released, got.PrivateIP)
+			}
+			if strings.Contains(c.String(), got.PublicKey) {
+				t.Errorf("Svc.Delete() left client in store: %s", c.String())
+			}
+		})
+	}
+}
+
+func TestSvc_List(t *testing.T) {
+	ctx := context.Background()
+
+	c := cache.NewMap()
+	s := wgclient.NewSvc(c, &fakeIP{}, fakeServer{})
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if _, err := s.GenerateConfig(ctx, &wgclient.GenerateConfigInput{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"b", "d"} {
+		if _, err := s.Update(ctx, id, &wgclient.UpdateInput{Labels: map[string]string{"team": "data"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		in       *wgclient.ListInput
+		wantIDs  []string
+		wantNext string
+	}{
+		{name: "TestListAll", in: &wgclient.ListInput{}, wantIDs: []string{"a", "b", "c", "d"}},
+		{name: "TestListFirstPage", in: &wgclient.ListInput{Limit: 2}, wantIDs: []string{"a", "b"}, wantNext: "b"},
+		{name: "TestListLastPage", in: &wgclient.ListInput{Limit: 2, After: "b"}, wantIDs: []string{"c", "d"}},
+		{name: "TestListLabels", in: &wgclient.ListInput{Labels: map[string]string{"team": "data"}}, wantIDs: []string{"b", "d"}},
+		{name: "TestListNoMatch", in: &wgclient.ListInput{Labels: map[string]string{"team": "web"}}, wantIDs: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.List(ctx, tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := []string{}
+			for _, cl := range got.Clients {
+				ids = append(ids, cl.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) || got.Next != tt.wantNext {
+				t.Errorf("Svc.List() = %v next %q, want %v next %q", ids, got.Next, tt.wantIDs, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestSvc_Update(t *testing.T) {
+	ctx := context.Background()
+	pk := "zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8="
+	taken := "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0="
+
+	tests := []struct {
+		name        string
+		id          string
+		in          *wgclient.UpdateInput
+		wantDNS     []string
+		wantLabels  map[string]string
+		wantPrivKey bool
+		wantErr     bool
+	}{
+		{
+			name:       "TestUpdateDNSAndLabels",
+			id:         "1",
+			in:         &wgclient.UpdateInput{DNSServers: []string{"10.90.0.5"}, Labels: map[string]string{"team": "data", "env": ""}},
+			wantDNS:    []string{"10.90.0.5"},
+			wantLabels: map[string]string{"team": "data"},
+		},
+		{name: "TestUpdatePublicKey", id: "1", in: &wgclient.UpdateInput{PublicKey: pk}, wantLabels: map[string]string{"env": "dev"}},
+		{name: "TestUpdateRotateKey", id: "1", in: &wgclient.UpdateInput{RotateKey: true}, wantLabels: map[string]string{"env": "dev"}, wantPrivKey: true},
+		{name: "TestUpdateDuplicateKey", id: "1", in: &wgclient.UpdateInput{PublicKey: taken}, wantErr: true},
+		{name: "TestUpdateInvalidKey", id: "1", in: &wgclient.UpdateInput{PublicKey: "dhfjdbfjdbffg"}, wantErr: true},
+		{name: "TestUpdateNotFound", id: "3", in: &wgclient.UpdateInput{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cache.NewMap()
+			s := wgclient.NewSvc(c, &fakeIP{}, fakeServer{})
+
+			old, err := s.GenerateConfig(ctx, &wgclient.GenerateConfigInput{ID: "1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Update(ctx, "1", &wgclient.UpdateInput{Labels: map[string]string{"env": "dev"}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.GenerateConfig(ctx, &wgclient.GenerateConfigInput{ID: "2", PublicKey: taken}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := s.Update(ctx, tt.id, tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Svc.Update() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if !reflect.DeepEqual(got.Client.DNSServers, tt.wantDNS) || !reflect.DeepEqual(got.Client.Labels, tt.wantLabels) {
+				t.Errorf("Svc.Update() = %+v", got.Client)
+			}
+			if (got.PrivateKey != "") != tt.wantPrivKey {
+				t.Errorf("Svc.Update() private key = %q, want %v", got.PrivateKey, tt.wantPrivKey)
+			}
+
+			// index keys follow public key.
+			if got.Client.PublicKey != old.Client.PublicKey && strings.Contains(c.String(), old.Client.PublicKey) {
+				t.Errorf("Svc.Update() left old public key in store: %s", c.String())
+			}
+			stored, err := s.Get(ctx, tt.id)
+			if err != nil || !reflect.DeepEqual(stored, got.Client) {
+				t.Errorf("Svc.Get() = %+v, %v, want %+v", stored, err, got.Client)
+			}
+			again, err := s.GenerateConfig(ctx, &wgclient.GenerateConfigInput{ID: "3", PublicKey: got.Client.PublicKey})
+			if err == nil {
+				t.Errorf("Svc.GenerateConfig() reused public key of updated client: %+v", again.Client)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package wgdevice
+
+import (
+	"context"
+	"sync"
+)
+
+// Fake is in-memory device, useful in tests.
+type Fake struct {
+	sync.RWMutex
+	device Device
+	err    error
+}
+
+// NewFake is constructor.
+func NewFake(name string, listenPort int) *Fake {
+	return &Fake{device: Device{Name: name, ListenPort: listenPort}}
+}
+
+// SetErr makes every further call fail with err.
+func (f *Fake) SetErr(err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.err = err
+}
+
+// AddPeer adds or replaces a peer (by public key).
+func (f *Fake) AddPeer(p Peer) {
+	f.Lock()
+	defer f.Unlock()
+
+	for i := range f.device.Peers {
+		if f.device.Peers[i].PublicKey == p.PublicKey {
+			f.device.Peers[i] = p
+			return
+		}
+	}
+	f.device.Peers = append(f.device.Peers, p)
+}
+
+// RemovePeer removes a peer.
+func (f *Fake) RemovePeer(publicKey string) {
+	f.Lock()
+	defer f.Unlock()
+
+	for i := range f.device.Peers {
+		if f.device.Peers[i].PublicKey == publicKey {
+			f.device.Peers = append(f.device.Peers[:i], f.device.Peers[i+1:]...)
+			return
+		}
+	}
+}
+
+// ConfigurePeers applies peer changes the way wireguard does.
+func (f *Fake) ConfigurePeers(ctx context.Context, peers []PeerConfig) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	for _, pc := range peers {
+		idx := -1
+		for i := range f.device.Peers {
+			if f.device.Peers[i].PublicKey == pc.PublicKey {
+				idx = i
+				break
+			}
+		}
+
+		if pc.Remove {
+			if idx >= 0 {
+				f.device.Peers = append(f.device.Peers[:idx], f.device.Peers[idx+1:]...)
+			}
+			continue
+		}
+
+		if idx < 0 {
+			f.device.Peers = append(f.device.Peers, Peer{PublicKey: pc.PublicKey})
+			idx = len(f.device.Peers) - 1
+		}
+
+		p := &f.device.Peers[idx]
+		p.PresharedKey = pc.PresharedKey
+		if pc.Endpoint != "" {
+			p.Endpoint = pc.Endpoint
+		}
+		p.PersistentKeepalive = pc.PersistentKeepalive
+		if pc.ReplaceAllowedIPs {
+			p.AllowedIPs = nil
+		}
+		p.AllowedIPs = append(p.AllowedIPs, pc.AllowedIPs...)
+	}
+
+	return nil
+}
+
+// Device returns copy of device state.
+func (f *Fake) Device(ctx context.Context) (*Device, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	d := f.device
+	d.Peers = make([]Peer, len(f.device.Peers))
+	for i, p := range f.device.Peers {
+		p.AllowedIPs = append([]string{}, p.AllowedIPs...)
+		d.Peers[i] = p
+	}
+	return &d, nil
+}
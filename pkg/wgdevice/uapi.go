@@ -0,0 +1,247 @@
+package wgdevice
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	defaultSocketDir = "/var/run/wireguard"
+)
+
+// UAPI talks to userspace wireguard (wireguard-go) over its unix socket.
+type UAPI struct {
+	name      string
+	socketDir string
+}
+
+// NewUAPI is constructor.
+func NewUAPI(name string) *UAPI {
+	return &UAPI{name: name, socketDir: defaultSocketDir}
+}
+
+// SetSocketDir set the directory containing <name>.sock.
+func (u *UAPI) SetSocketDir(dir string) {
+	u.socketDir = dir
+}
+
+// Device returns current device state.
+func (u *UAPI) Device(ctx context.Context) (*Device, error) {
+	conn, err := u.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "get=1\n\n"); err != nil {
+		return nil, fmt.Errorf("uapi:get:%v", err)
+	}
+
+	d, err := parseGet(conn)
+	if err != nil {
+		return nil, fmt.Errorf("uapi:get:%v", err)
+	}
+
+	d.Name = u.name
+	return d, nil
+}
+
+// ConfigurePeers adds, updates or removes peers on device.
+func (u *UAPI) ConfigurePeers(ctx context.Context, peers []PeerConfig) error {
+	req, err := setRequest(peers)
+	if err != nil {
+		return fmt.Errorf("uapi:set:%v", err)
+	}
+
+	conn, err := u.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, req); err != nil {
+		return fmt.Errorf("uapi:set:%v", err)
+	}
+
+	if _, err := parseGet(conn); err != nil {
+		return fmt.Errorf("uapi:set:%v", err)
+	}
+	return nil
+}
+
+func (u *UAPI) dial(ctx context.Context) (net.Conn, error) {
+	path := filepath.Join(u.socketDir, u.name+".sock")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, ErrDeviceNotFound
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("uapi:dial:%v", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// parseGet parses response of get=1 operation.
+func parseGet(r io.Reader) (*Device, error) {
+	d := &Device{}
+
+	var (
+		peer    *Peer
+		hsSec   int64
+		hsNsec  int64
+		errno   = -1
+		scanner = bufio.NewScanner(r)
+	)
+
+	flush := func() {
+		if peer == nil {
+			return
+		}
+		if hsSec != 0 || hsNsec != 0 {
+			peer.LastHandshake = time.Unix(hsSec, hsNsec).UTC()
+		}
+		d.Peers = append(d.Peers, *peer)
+		peer, hsSec, hsNsec = nil, 0, 0
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		k, v := kv[0], kv[1]
+
+		var err error
+		switch k {
+		case "errno":
+			errno, err = strconv.Atoi(v)
+		case "listen_port":
+			d.ListenPort, err = strconv.Atoi(v)
+		case "public_key":
+			flush()
+			peer = &Peer{}
+			peer.PublicKey, err = hexToBase64(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%v", k, err)
+		}
+
+		// rest of the keys belong to a peer.
+		if peer == nil || k == "public_key" {
+			continue
+		}
+
+		switch k {
+		case "preshared_key":
+			if strings.Trim(v, "0") != "" {
+				peer.PresharedKey, err = hexToBase64(v)
+			}
+		case "endpoint":
+			peer.Endpoint = v
+		case "allowed_ip":
+			peer.AllowedIPs = append(peer.AllowedIPs, v)
+		case "persistent_keepalive_interval":
+			peer.PersistentKeepalive, err = strconv.Atoi(v)
+		case "last_handshake_time_sec":
+			hsSec, err = strconv.ParseInt(v, 10, 64)
+		case "last_handshake_time_nsec":
+			hsNsec, err = strconv.ParseInt(v, 10, 64)
+		case "rx_bytes":
+			peer.ReceiveBytes, err = strconv.ParseInt(v, 10, 64)
+		case "tx_bytes":
+			peer.TransmitBytes, err = strconv.ParseInt(v, 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%v", k, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	if errno != 0 {
+		return nil, fmt.Errorf("errno=%d", errno)
+	}
+	return d, nil
+}
+
+// setRequest builds set=1 operation for peers.
+func setRequest(peers []PeerConfig) (string, error) {
+	var b strings.Builder
+
+	b.WriteString("set=1\n")
+	for _, p := range peers {
+		pk, err := base64ToHex(p.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("public_key:%v", err)
+		}
+		fmt.Fprintf(&b, "public_key=%s\n", pk)
+
+		if p.Remove {
+			b.WriteString("remove=true\n")
+			continue
+		}
+		psk := strings.Repeat("0", 64)
+		if p.PresharedKey != "" {
+			psk, err = base64ToHex(p.PresharedKey)
+			if err != nil {
+				return "", fmt.Errorf("preshared_key:%v", err)
+			}
+		}
+		fmt.Fprintf(&b, "preshared_key=%s\n", psk)
+		if p.Endpoint != "" {
+			fmt.Fprintf(&b, "endpoint=%s\n", p.Endpoint)
+		}
+		fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", p.PersistentKeepalive)
+		if p.ReplaceAllowedIPs {
+			b.WriteString("replace_allowed_ips=true\n")
+		}
+		for _, ip := range p.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", ip)
+		}
+	}
+	b.WriteString("\n")
+
+	return b.String(), nil
+}
+
+func base64ToHex(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	if len(b) != 32 {
+		return "", fmt.Errorf("invalid key length %d", len(b))
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hexToBase64(s string) (string, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
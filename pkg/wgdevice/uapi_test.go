@@ -0,0 +1,112 @@
+package wgdevice_test
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/pkg/wgdevice"
+)
+
+// uapiServer serves a canned response for every get=1 on a unix socket.
+func uapiServer(t *testing.T, dir, name, resp string) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("unix", filepath.Join(dir, name+".sock"))
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == "\n" {
+					break
+				}
+			}
+			conn.Write([]byte(resp))
+			conn.Close()
+		}
+	}()
+
+	return l
+}
+
+func TestUAPI_Device(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := uapiServer(t, dir, "wg0", "private_key=e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a\n"+
+		"listen_port=51820\n"+
+		"public_key=b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33\n"+
+		"endpoint=[abcd:23::33%2]:51820\n"+
+		"last_handshake_time_sec=1591000000\n"+
+		"last_handshake_time_nsec=0\n"+
+		"tx_bytes=38333\n"+
+		"rx_bytes=2224\n"+
+		"persistent_keepalive_interval=25\n"+
+		"allowed_ip=192.168.4.4/32\n"+
+		"allowed_ip=fd00::4/128\n"+
+		"public_key=58402e695ba1772b1cc9309755f043251ea77fdcf10fbe63989ceb7e19321376\n"+
+		"allowed_ip=192.168.4.6/32\n"+
+		"errno=0\n\n")
+	defer l.Close()
+
+	tests := []struct {
+		name    string
+		iface   string
+		wantErr bool
+	}{
+		{name: "TestDeviceNotFound", iface: "wg1", wantErr: true},
+		{name: "TestDeviceSuccess", iface: "wg0", wantErr: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := wgdevice.NewUAPI(tt.iface)
+			u.SetSocketDir(dir)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			d, err := u.Device(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UAPI.Device() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if d.Name != "wg0" || d.ListenPort != 51820 || len(d.Peers) != 2 {
+				t.Fatalf("UAPI.Device() = %+v", d)
+			}
+
+			p := d.Peers[0]
+			if p.PublicKey != "uFmW/sycfx/G0lcqdu2hHVm80gvo5UOxXOS9hajnWjM=" {
+				t.Errorf("UAPI.Device() public key = %v", p.PublicKey)
+			}
+			if len(p.AllowedIPs) != 2 || p.PersistentKeepalive != 25 || p.ReceiveBytes != 2224 || p.TransmitBytes != 38333 {
+				t.Errorf("UAPI.Device() peer = %+v", p)
+			}
+			if p.LastHandshake.Unix() != 1591000000 {
+				t.Errorf("UAPI.Device() handshake = %v", p.LastHandshake)
+			}
+			if !d.Peers[1].LastHandshake.IsZero() {
+				t.Errorf("UAPI.Device() handshake = %v, want zero", d.Peers[1].LastHandshake)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package wgdevice
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrDeviceNotFound means wireguard interface is not up.
+	ErrDeviceNotFound = errors.New("wireguard device not found")
+)
+
+// Peer is state of a peer configured on device.
+type Peer struct {
+	PublicKey           string    `json:"public_key,omitempty"` // base64
+	PresharedKey        string    `json:"-"`                    // base64
+	Endpoint            string    `json:"endpoint,omitempty"`
+	AllowedIPs          []string  `json:"allowed_ips,omitempty"`
+	PersistentKeepalive int       `json:"persistent_keepalive,omitempty"` // seconds
+	LastHandshake       time.Time `json:"last_handshake,omitempty"`
+	ReceiveBytes        int64     `json:"rx_bytes,omitempty"`
+	TransmitBytes       int64     `json:"tx_bytes,omitempty"`
+}
+
+// Device is state of a wireguard interface.
+type Device struct {
+	Name       string `json:"name,omitempty"`
+	ListenPort int    `json:"listen_port,omitempty"`
+	Peers      []Peer `json:"peers,omitempty"`
+}
+
+// PeerConfig is change to be applied on a peer.
+type PeerConfig struct {
+	PublicKey           string   `json:"public_key,omitempty"` // base64
+	PresharedKey        string   `json:"-"`                    // base64, empty removes it
+	Remove              bool     `json:"remove,omitempty"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"` // seconds
+	ReplaceAllowedIPs   bool     `json:"replace_allowed_ips,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips,omitempty"`
+}
@@ -0,0 +1,96 @@
+package wgkey
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// KeyLen is length of curve25519 keys in bytes.
+const KeyLen = 32
+
+var (
+	// ErrInvalidKey means key is not base64 encoded 32 bytes.
+	ErrInvalidKey = errors.New("invalid wireguard key")
+
+	// ErrZeroKey means key is all zeros.
+	ErrZeroKey = errors.New("zero wireguard key")
+)
+
+// KeyPair is curve25519 key pair, base64 encoded.
+type KeyPair struct {
+	PrivateKey string `json:"private_key,omitempty"`
+	PublicKey  string `json:"public_key,omitempty"`
+}
+
+// Validate checks key is a base64 encoded curve25519 key as used by wg(8).
+func Validate(key string) error {
+	_, err := parse(key)
+	return err
+}
+
+// GenerateKeyPair generates a new private key and its public key.
+func GenerateKeyPair() (*KeyPair, error) {
+	priv, err := random()
+	if err != nil {
+		return nil, err
+	}
+
+	// clamp as per https://cr.yp.to/ecdh.html
+	priv[0] &= 248
+	priv[31] = (priv[31] & 127) | 64
+
+	var pub [KeyLen]byte
+	curve25519.ScalarBaseMult(&pub, &priv)
+
+	return &KeyPair{PrivateKey: encode(priv), PublicKey: encode(pub)}, nil
+}
+
+// PublicKey derives public key of a private key.
+func PublicKey(privateKey string) (string, error) {
+	priv, err := parse(privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	var pub [KeyLen]byte
+	curve25519.ScalarBaseMult(&pub, &priv)
+
+	return encode(pub), nil
+}
+
+// GeneratePresharedKey generates a symmetric preshared key.
+func GeneratePresharedKey() (string, error) {
+	k, err := random()
+	if err != nil {
+		return "", err
+	}
+	return encode(k), nil
+}
+
+func parse(key string) ([KeyLen]byte, error) {
+	var k [KeyLen]byte
+
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != KeyLen {
+		return k, ErrInvalidKey
+	}
+	copy(k[:], b)
+
+	if k == [KeyLen]byte{} {
+		return k, ErrZeroKey
+	}
+	return k, nil
+}
+
+func random() ([KeyLen]byte, error) {
+	var k [KeyLen]byte
+	_, err := rand.Read(k[:])
+	return k, err
+}
+
+func encode(k [KeyLen]byte) string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
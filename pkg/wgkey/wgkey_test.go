@@ -0,0 +1,53 @@
+package wgkey_test
+
+import (
+	"testing"
+
+	"bitbucket.org/qubole/wireguard/pkg/wgkey"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr error
+	}{
+		{name: "TestValidateSuccess", key: "zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8=", wantErr: nil},
+		{name: "TestValidateNotBase64", key: "dhfjdbfjdbffg", wantErr: wgkey.ErrInvalidKey},
+		{name: "TestValidateShort", key: "c2hvcnQ=", wantErr: wgkey.ErrInvalidKey},
+		{name: "TestValidateEmpty", key: "", wantErr: wgkey.ErrInvalidKey},
+		{name: "TestValidateZero", key: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", wantErr: wgkey.ErrZeroKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := wgkey.Validate(tt.key); err != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublicKey(t *testing.T) {
+	// deploy/client/wg0.conf private key, registered as 10.0.0.2 peer in deploy/server/wireguard.yml.
+	priv := "eAcRJrQBgb95AYi1pZDhdrISfuKo/F4Z1pnbjtfXjE0="
+	want := "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0="
+
+	pub, err := wgkey.PublicKey(priv)
+	if err != nil || pub != want {
+		t.Errorf("PublicKey() = %v, %v, want %v", pub, err, want)
+	}
+
+	kp, err := wgkey.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error = %v", err)
+	}
+	got, err := wgkey.PublicKey(kp.PrivateKey)
+	if err != nil || got != kp.PublicKey {
+		t.Errorf("PublicKey() = %v, %v, want %v", got, err, kp.PublicKey)
+	}
+
+	psk, err := wgkey.GeneratePresharedKey()
+	if err != nil || wgkey.Validate(psk) != nil || psk == kp.PrivateKey {
+		t.Errorf("GeneratePresharedKey() = %v, %v", psk, err)
+	}
+}
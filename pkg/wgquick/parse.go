@@ -0,0 +1,252 @@
+package wgquick
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"bitbucket.org/qubole/wireguard/pkg/wgclient"
+	"bitbucket.org/qubole/wireguard/pkg/wgkey"
+	"bitbucket.org/qubole/wireguard/pkg/wgpeer"
+	"bitbucket.org/qubole/wireguard/pkg/wgserver"
+)
+
+var (
+	// nameComment names a peer, e.g. "# Name = laptop".
+	nameComment = regexp.MustCompile(`^#\s*[Nn]ame\s*[:=]\s*(.+?)\s*$`)
+)
+
+// Unmarshal parses wg-quick(8) config file.
+// Keys are case insensitive, list keys may be repeated or comma separated and
+// everything after # is a comment, like in wg-quick.
+func Unmarshal(data []byte) (*Config, error) {
+	c := &Config{}
+
+	var (
+		section string
+		peer    *Peer
+		lineNo  int
+		scanner = bufio.NewScanner(bytes.NewReader(data))
+	)
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		if m := nameComment.FindStringSubmatch(line); m != nil && peer != nil {
+			peer.Name = m[1]
+		}
+
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+				peer = nil
+			case "peer":
+				c.Peers = append(c.Peers, Peer{})
+				peer = &c.Peers[len(c.Peers)-1]
+			default:
+				return nil, fmt.Errorf("line %d: unknown section %q", lineNo, line)
+			}
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		key, val := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+
+		var err error
+		switch section {
+		case "interface":
+			err = c.Interface.set(key, val)
+		case "peer":
+			err = peer.set(key, val)
+		default:
+			err = fmt.Errorf("key outside section")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (i *Interface) set(key, val string) error {
+	var err error
+
+	switch key {
+	case "privatekey":
+		i.PrivateKey = val
+		err = wgkey.Validate(val)
+	case "address":
+		i.Address = append(i.Address, splitList(val)...)
+	case "listenport":
+		i.ListenPort, err = strconv.Atoi(val)
+	case "dns":
+		i.DNS = append(i.DNS, splitList(val)...)
+	case "mtu":
+		i.MTU, err = strconv.Atoi(val)
+	case "table":
+		i.Table = val
+	case "fwmark":
+		i.FwMark = val
+	case "preup":
+		i.PreUp = append(i.PreUp, val)
+	case "postup":
+		i.PostUp = append(i.PostUp, val)
+	case "predown":
+		i.PreDown = append(i.PreDown, val)
+	case "postdown":
+		i.PostDown = append(i.PostDown, val)
+	case "saveconfig":
+		i.SaveConfig, err = strconv.ParseBool(val)
+	default:
+		return fmt.Errorf("unknown interface key %q", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	return nil
+}
+
+func (p *Peer) set(key, val string) error {
+	var err error
+
+	switch key {
+	case "publickey":
+		p.PublicKey = val
+		err = wgkey.Validate(val)
+	case "presharedkey":
+		p.PresharedKey = val
+		err = wgkey.Validate(val)
+	case "allowedips":
+		p.AllowedIPs = append(p.AllowedIPs, splitList(val)...)
+	case "endpoint":
+		p.Endpoint = val
+	case "persistentkeepalive":
+		if val != "off" {
+			p.PersistentKeepalive, err = strconv.Atoi(val)
+		}
+	default:
+		return fmt.Errorf("unknown peer key %q", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	return nil
+}
+
+// WGPeers returns [Peer] sections as peers.
+func (c *Config) WGPeers() []wgpeer.WGPeer {
+	ps := make([]wgpeer.WGPeer, 0, len(c.Peers))
+	for _, p := range c.Peers {
+		ps = append(ps, wgpeer.WGPeer{
+			PublicKey:  p.PublicKey,
+			AllowedIPS: p.AllowedIPs,
+			EndPoint:   p.Endpoint,
+			KeepAlive:  p.PersistentKeepalive,
+		})
+	}
+	return ps
+}
+
+// WGClients returns peers whose allowed ips are a single ipv4 and/or ipv6 host,
+// i.e. clients of a server config.
+// Client id is the peer name if present else its public key.
+func (c *Config) WGClients() []*wgclient.WGClient {
+	cs := []*wgclient.WGClient{}
+	for _, p := range c.Peers {
+		ip, ipv6 := hostIPs(p.AllowedIPs)
+		if ip == "" {
+			continue
+		}
+
+		id := p.Name
+		if id == "" {
+			id = p.PublicKey
+		}
+		cs = append(cs, &wgclient.WGClient{
+			ID: id, PrivateIP: ip, PrivateIPv6: ipv6, PublicKey: p.PublicKey, PresharedKey: p.PresharedKey,
+		})
+	}
+	return cs
+}
+
+// OtherPeers returns peers which are not clients, e.g. site-to-site peers routing subnets.
+func (c *Config) OtherPeers() []Peer {
+	ps := []Peer{}
+	for _, p := range c.Peers {
+		if ip, _ := hostIPs(p.AllowedIPs); ip == "" {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// WGServer returns [Interface] section as server with id.
+// Public key is derived when config has private key.
+func (c *Config) WGServer(id string) (*wgserver.WGServer, error) {
+	s := &wgserver.WGServer{ID: id, ListenPort: c.Interface.ListenPort}
+	if len(c.Interface.Address) > 0 {
+		s.PrivateIP = strings.SplitN(c.Interface.Address[0], "/", 2)[0]
+	}
+
+	if c.Interface.PrivateKey != "" {
+		pk, err := wgkey.PublicKey(c.Interface.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		s.PublicKey = pk
+	}
+
+	return s, nil
+}
+
+// hostIPs returns ipv4 and ipv6 of allowed ips if they are just one /32 and at most one /128.
+func hostIPs(allowed []string) (string, string) {
+	var ip, ipv6 string
+	for _, a := range allowed {
+		parts := strings.SplitN(a, "/", 2)
+		if len(parts) == 2 && hostCIDR(parts[0]) != a {
+			return "", ""
+		}
+
+		switch {
+		case strings.Contains(parts[0], ":") && ipv6 == "":
+			ipv6 = parts[0]
+		case !strings.Contains(parts[0], ":") && ip == "":
+			ip = parts[0]
+		default:
+			return "", ""
+		}
+	}
+	return ip, ipv6
+}
+
+func splitList(val string) []string {
+	vs := []string{}
+	for _, v := range strings.Split(val, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
@@ -0,0 +1,134 @@
+package wgquick_test
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"bitbucket.org/qubole/wireguard/pkg/wgclient"
+	"bitbucket.org/qubole/wireguard/pkg/wgquick"
+)
+
+// configMap is wg0.conf of deploy/server/wireguard.yml.
+var configMap = `[Interface]
+Address = 10.0.0.1/24
+ListenPort = 51820
+PostUp = wg set wg0 private-key /etc/wireguard/privatekey && iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE
+PostUp = printf "nameserver 10.90.0.5\nsearch default.svc.cluster.local svc.cluster.local cluster.local" | resolvconf -a %i
+PostDown = iptables -t nat -D POSTROUTING -o eth0 -j MASQUERADE
+SaveConfig = true
+
+[Peer]
+PublicKey = zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8=
+AllowedIPs = 192.168.1.4/32
+
+[Peer]
+# Name = laptop
+PublicKey = ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0=
+AllowedIPs = 10.0.0.2/32 # client
+`
+
+func TestUnmarshal(t *testing.T) {
+	deploy, err := ioutil.ReadFile("../../deploy/server/wg0.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		data        string
+		wantAddress []string
+		wantPostUp  int
+		wantClients []*wgclient.WGClient
+		wantOthers  int
+		wantErr     bool
+	}{
+		{
+			name:        "TestUnmarshalDeployServer",
+			data:        string(deploy),
+			wantAddress: []string{"10.33.0.1/24"},
+			wantPostUp:  1,
+			wantClients: []*wgclient.WGClient{
+				{ID: "zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8=", PublicKey: "zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8=", PrivateIP: "192.168.1.4"},
+			},
+		},
+		{
+			name:        "TestUnmarshalConfigMap",
+			data:        configMap,
+			wantAddress: []string{"10.0.0.1/24"},
+			wantPostUp:  2,
+			wantClients: []*wgclient.WGClient{
+				{ID: "zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8=", PublicKey: "zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8=", PrivateIP: "192.168.1.4"},
+				{ID: "laptop", PublicKey: "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0=", PrivateIP: "10.0.0.2"},
+			},
+		},
+		{
+			name:        "TestUnmarshalMultiValued",
+			data:        "[interface]\naddress = 10.0.0.1/24, fd00::1/64\nAddress=10.1.0.1/24\n[Peer]\nPublicKey=zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8=\nAllowedIPs=10.0.0.0/8\nAllowedIPs=fd00::/64\n",
+			wantAddress: []string{"10.0.0.1/24", "fd00::1/64", "10.1.0.1/24"},
+			wantClients: []*wgclient.WGClient{},
+			wantOthers:  1,
+		},
+		{
+			name:        "TestUnmarshalDualStack",
+			data:        "[Interface]\nAddress = 10.0.0.1/24, fd00::1/64\n[Peer]\n# Name = laptop\nPublicKey = ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0=\nAllowedIPs = 10.0.0.2/32, fd00::2/128\n",
+			wantAddress: []string{"10.0.0.1/24", "fd00::1/64"},
+			wantClients: []*wgclient.WGClient{
+				{ID: "laptop", PublicKey: "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0=", PrivateIP: "10.0.0.2", PrivateIPv6: "fd00::2"},
+			},
+		},
+		{name: "TestUnmarshalUnknownKey", data: "[Interface]\nFoo = bar\n", wantErr: true},
+		{name: "TestUnmarshalUnknownSection", data: "[Foo]\n", wantErr: true},
+		{name: "TestUnmarshalKeyOutsideSection", data: "Address = 10.0.0.1/24\n", wantErr: true},
+		{name: "TestUnmarshalInvalidKey", data: "[Peer]\nPublicKey = dhfjdbfjdbffg\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := wgquick.Unmarshal([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if !reflect.DeepEqual(got.Interface.Address, tt.wantAddress) {
+				t.Errorf("Unmarshal() address = %v, want %v", got.Interface.Address, tt.wantAddress)
+			}
+			if len(got.Interface.PostUp) != tt.wantPostUp {
+				t.Errorf("Unmarshal() postup = %v, want %d", got.Interface.PostUp, tt.wantPostUp)
+			}
+			if !reflect.DeepEqual(got.WGClients(), tt.wantClients) {
+				t.Errorf("Unmarshal() clients = %+v, want %+v", got.WGClients(), tt.wantClients)
+			}
+			if len(got.OtherPeers()) != tt.wantOthers {
+				t.Errorf("Unmarshal() other peers = %+v, want %d", got.OtherPeers(), tt.wantOthers)
+			}
+		})
+	}
+}
+
+func TestConfig_WGServer(t *testing.T) {
+	// private key of deploy/server, its public key is the peer of deploy/client/wg0.conf.
+	c, err := wgquick.Unmarshal([]byte("[Interface]\nAddress = 10.33.0.1/24\nPrivateKey = 2G7+CIjVzksQZ7tG2kaiJfQ59BzjZHtPLi5Kzi/s6VU=\nListenPort = 51820\nSaveConfig = true\n"))
+	if err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if !c.Interface.SaveConfig || c.Interface.ListenPort != 51820 {
+		t.Errorf("Unmarshal() interface = %+v", c.Interface)
+	}
+
+	s, err := c.WGServer("server1")
+	if err != nil {
+		t.Fatalf("Config.WGServer() error = %v", err)
+	}
+	if s.ID != "server1" || s.PrivateIP != "10.33.0.1" || s.ListenPort != 51820 || s.PublicKey != "8AnbIFIos5HjXibVWBjRxJhdqw/evd1pXsNCRvBmCnI=" {
+		t.Errorf("Config.WGServer() = %+v", s)
+	}
+
+	// round trip
+	again, err := wgquick.Unmarshal(wgquick.Marshal(c))
+	if err != nil || !reflect.DeepEqual(again, c) {
+		t.Errorf("Unmarshal(Marshal()) = %+v, %v, want %+v", again, err, c)
+	}
+}
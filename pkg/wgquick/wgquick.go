@@ -0,0 +1,146 @@
+package wgquick
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"bitbucket.org/qubole/wireguard/pkg/wgclient"
+)
+
+var (
+	// privateKeyPostUp loads private key from file when it is not known to server.
+	privateKeyPostUp = "wg set %i private-key /etc/wireguard/privatekey"
+)
+
+// Interface is [Interface] section of wg-quick config.
+type Interface struct {
+	PrivateKey string
+	Address    []string
+	ListenPort int
+	DNS        []string
+	MTU        int
+	Table      string
+	FwMark     string
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+	SaveConfig bool
+}
+
+// Peer is [Peer] section of wg-quick config.
+type Peer struct {
+	Name                string // from "# Name = ..." comment
+	PublicKey           string
+	PresharedKey        string
+	AllowedIPs          []string
+	Endpoint            string
+	PersistentKeepalive int
+}
+
+// Config is wg-quick(8) config file.
+type Config struct {
+	Interface Interface
+	Peers     []Peer
+}
+
+// FromGenerateConfig makes client config out of GenerateConfig response.
+// If private key of client is not known PostUp loads it from /etc/wireguard/privatekey.
+func FromGenerateConfig(out *wgclient.GenerateConfigOutput) *Config {
+	c := &Config{}
+	if out.Client != nil {
+		c.Interface.Address = out.Client.AllowedIPs()
+		c.Interface.DNS = out.Client.DNSServers
+	}
+
+	c.Interface.PrivateKey = out.PrivateKey
+	if c.Interface.PrivateKey == "" {
+		c.Interface.PostUp = []string{privateKeyPostUp}
+	}
+
+	for _, p := range out.Peers {
+		peer := Peer{
+			PublicKey:           p.PublicKey,
+			AllowedIPs:          p.AllowedIPS,
+			Endpoint:            p.EndPoint,
+			PersistentKeepalive: p.KeepAlive,
+		}
+		if out.Client != nil {
+			peer.PresharedKey = out.Client.PresharedKey
+		}
+		c.Peers = append(c.Peers, peer)
+	}
+
+	return c
+}
+
+// Marshal renders config as wg-quick INI document.
+func Marshal(c *Config) []byte {
+	var b bytes.Buffer
+
+	b.WriteString("[Interface]\n")
+	writeList(&b, "Address", c.Interface.Address)
+	writeInt(&b, "ListenPort", c.Interface.ListenPort)
+	writeString(&b, "PrivateKey", c.Interface.PrivateKey)
+	writeList(&b, "DNS", c.Interface.DNS)
+	writeInt(&b, "MTU", c.Interface.MTU)
+	writeString(&b, "Table", c.Interface.Table)
+	writeString(&b, "FwMark", c.Interface.FwMark)
+	writeEach(&b, "PreUp", c.Interface.PreUp)
+	writeEach(&b, "PostUp", c.Interface.PostUp)
+	writeEach(&b, "PreDown", c.Interface.PreDown)
+	writeEach(&b, "PostDown", c.Interface.PostDown)
+	if c.Interface.SaveConfig {
+		writeString(&b, "SaveConfig", "true")
+	}
+
+	for _, p := range c.Peers {
+		b.WriteString("\n[Peer]\n")
+		if p.Name != "" {
+			fmt.Fprintf(&b, "# Name = %s\n", p.Name)
+		}
+		writeString(&b, "PublicKey", p.PublicKey)
+		writeString(&b, "PresharedKey", p.PresharedKey)
+		writeList(&b, "AllowedIPs", p.AllowedIPs)
+		writeString(&b, "Endpoint", p.Endpoint)
+		writeInt(&b, "PersistentKeepalive", p.PersistentKeepalive)
+	}
+
+	return b.Bytes()
+}
+
+func writeString(b *bytes.Buffer, key, val string) {
+	if val == "" {
+		return
+	}
+	fmt.Fprintf(b, "%s = %s\n", key, val)
+}
+
+func writeInt(b *bytes.Buffer, key string, val int) {
+	if val == 0 {
+		return
+	}
+	fmt.Fprintf(b, "%s = %d\n", key, val)
+}
+
+func writeList(b *bytes.Buffer, key string, vals []string) {
+	writeString(b, key, strings.Join(vals, ", "))
+}
+
+func writeEach(b *bytes.Buffer, key string, vals []string) {
+	for _, v := range vals {
+		writeString(b, key, v)
+	}
+}
+
+// hostCIDR returns single host cidr of ip.
+func hostCIDR(ip string) string {
+	if ip == "" || strings.Contains(ip, "/") {
+		return ip
+	}
+	if strings.Contains(ip, ":") {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
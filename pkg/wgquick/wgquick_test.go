@@ -0,0 +1,94 @@
+package wgquick_test
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"bitbucket.org/qubole/wireguard/pkg/wgclient"
+	"bitbucket.org/qubole/wireguard/pkg/wgpeer"
+	"bitbucket.org/qubole/wireguard/pkg/wgquick"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestMarshal_FromGenerateConfig(t *testing.T) {
+	server := wgpeer.WGPeer{
+		PublicKey:  "8AnbIFIos5HjXibVWBjRxJhdqw/evd1pXsNCRvBmCnI=",
+		AllowedIPS: []string{"10.0.0.0/8"},
+		EndPoint:   "34.93.47.5:51820",
+		KeepAlive:  30,
+	}
+
+	tests := []struct {
+		name   string
+		golden string
+		out    *wgclient.GenerateConfigOutput
+	}{
+		{
+			name:   "TestMarshalServerGeneratedKey",
+			golden: "server_key.conf",
+			out: &wgclient.GenerateConfigOutput{
+				Client: &wgclient.WGClient{
+					ID: "5", PrivateIP: "10.0.0.2", PublicKey: "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0=",
+					DNSServers: []string{"8.8.8.8", "4.4.4.4"},
+				},
+				PrivateKey: "eAcRJrQBgb95AYi1pZDhdrISfuKo/F4Z1pnbjtfXjE0=",
+				Peers:      []wgpeer.WGPeer{server},
+			},
+		},
+		{
+			name:   "TestMarshalClientKeyWithPSK",
+			golden: "client_key_psk.conf",
+			out: &wgclient.GenerateConfigOutput{
+				Client: &wgclient.WGClient{
+					ID: "6", PrivateIP: "10.0.0.3", PublicKey: "zGqJG7CmMIEmztwt22/75oUOCtJTiYSUEKxj7zW0vU8=",
+					PresharedKey: "2G7+CIjVzksQZ7tG2kaiJfQ59BzjZHtPLi5Kzi/s6VU=",
+				},
+				Peers: []wgpeer.WGPeer{
+					server,
+					{PublicKey: "4NkU0MYF3sdB28TL5qibSOA6aHMiHj/5MCQ8Qr87O3Y=", AllowedIPS: []string{"10.33.0.0/24", "192.168.1.0/24"}, EndPoint: "vpn.example.com:51820"},
+				},
+			},
+		},
+		{
+			name:   "TestMarshalDualStack",
+			golden: "dual_stack.conf",
+			out: &wgclient.GenerateConfigOutput{
+				Client: &wgclient.WGClient{
+					ID: "8", PrivateIP: "10.0.0.5", PrivateIPv6: "fd00::5", PublicKey: "ylJLmvdEhcWkegHUGkUvp8SHc5u54XTM/y6GwxE7pR0=",
+				},
+				Peers: []wgpeer.WGPeer{server},
+			},
+		},
+		{
+			name:   "TestMarshalNoPeers",
+			golden: "no_peers.conf",
+			out: &wgclient.GenerateConfigOutput{
+				Client: &wgclient.WGClient{ID: "7", PrivateIP: "10.0.0.4"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := wgquick.Marshal(wgquick.FromGenerateConfig(tt.out))
+
+			path := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := ioutil.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Marshal() = \n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
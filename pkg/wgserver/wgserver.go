@@ -2,69 +2,525 @@ package wgserver
 
 import (
 	"context"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"bitbucket.org/qubole/wireguard/pkg/wgclient"
+	"bitbucket.org/qubole/wireguard/pkg/wgdevice"
+	"bitbucket.org/qubole/wireguard/pkg/wgkey"
 	"bitbucket.org/qubole/wireguard/pkg/wgpeer"
 )
 
+func init() {
+	// stored by value encoding stores.
+	gob.Register(&WGServer{})
+	gob.Register(&WGPeerStatus{})
+}
+
 // IPSvc to fetch IP.
 type IPSvc interface {
 	Get(context.Context) (string, error)
+	Reserve(context.Context, string) error
+	Release(context.Context, string) error
 }
 
 // Store interface.
 type Store interface {
 	Get(context.Context, string) (interface{}, error)
 	Set(context.Context, string, interface{}, ...int) error
+	Delete(context.Context, string) (interface{}, error)
+	Keys(context.Context, string) ([]string, error)
+}
+
+// DeviceReader reads state of local wireguard interface.
+type DeviceReader interface {
+	Device(context.Context) (*wgdevice.Device, error)
+}
+
+// DeviceWriter changes peers of local wireguard interface.
+type DeviceWriter interface {
+	ConfigurePeers(context.Context, []wgdevice.PeerConfig) error
+}
+
+// Device is local wireguard interface.
+type Device interface {
+	DeviceReader
+	DeviceWriter
+}
+
+const defaultListenPort = 51820
+
+// ErrNotFound is returned for unregistered wgserver.
+var ErrNotFound = errors.New("wgserver:not_found")
+
+// ErrInvalidID is returned for empty server id or one containing ':', which separates store keys.
+var ErrInvalidID = errors.New("wgserver:invalid_id")
+
+// ValidationError means input is invalid, it is a bad request unlike store or device errors.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ":" + e.Reason
 }
 
 // WGServer info.
 type WGServer struct {
-	ID        string `json:"id,omitempty"`
-	PrivateIP string `json:"private_ip,omitempty"`
-	Endpoint  string `json:"endpoint,omitempty"` // public IP or cname accessible by client
-	PublicKey string `json:"public_key,omitempty"`
+	ID         string   `json:"id,omitempty"`
+	PrivateIP  string   `json:"private_ip,omitempty"`
+	Endpoint   string   `json:"endpoint,omitempty"` // public IP or cname accessible by client
+	ListenPort int      `json:"listen_port,omitempty"`
+	PublicKey  string   `json:"public_key,omitempty"`
+	CIDRs      []string `json:"cidrs,omitempty"` // networks routed to server by clients
+}
+
+// Peer returns server as a peer of clients.
+// Clients route served cidrs to server, or only its private ip when it serves none.
+func (w *WGServer) Peer() wgpeer.WGPeer {
+	p := wgpeer.WGPeer{PublicKey: w.PublicKey, EndPoint: w.Endpoint, AllowedIPS: w.CIDRs}
+
+	if _, _, err := net.SplitHostPort(w.Endpoint); err != nil && w.Endpoint != "" && w.ListenPort != 0 {
+		p.EndPoint = net.JoinHostPort(w.Endpoint, strconv.Itoa(w.ListenPort))
+	}
+
+	if len(p.AllowedIPS) == 0 && w.PrivateIP != "" {
+		bits := "/32"
+		if strings.Contains(w.PrivateIP, ":") {
+			bits = "/128"
+		}
+		p.AllowedIPS = []string{w.PrivateIP + bits}
+	}
+	return p
+}
+
+// WGPeerStatus is state of a peer as seen on wgserver device.
+type WGPeerStatus struct {
+	wgpeer.WGPeer
+	ServerID      string    `json:"server_id,omitempty"`
+	LastHandshake time.Time `json:"last_handshake,omitempty"`
+	ReceiveBytes  int64     `json:"rx_bytes,omitempty"`
+	TransmitBytes int64     `json:"tx_bytes,omitempty"`
+	ScrapedAt     time.Time `json:"scraped_at,omitempty"`
+}
+
+// ServerStatus is liveness of a registered wgserver.
+// A server is alive while its last heartbeat is younger than heartbeat ttl.
+type ServerStatus struct {
+	*WGServer
+	Alive         bool      `json:"alive"`
+	LastHeartbeat time.Time `json:"last_heartbeat,omitempty"`
+}
+
+// SyncSummary is result of one CronSyncPeersFromStore run.
+type SyncSummary struct {
+	Added   int      `json:"added"`
+	Updated int      `json:"updated"`
+	Removed int      `json:"removed"`
+	Failed  int      `json:"failed"`
+	Errors  []string `json:"errors,omitempty"`
 }
 
 // Svc struct.
 type Svc struct {
+	id            string
 	store         Store
 	ip            IPSvc
-	sshPublicKey  string `json:"ssh_public_key,omitempty"`
-	sshPrivateKey string `json:"ssh_private_key,omitempty"`
+	device        Device
+	sshPublicKey  string
+	sshPrivateKey string
+	heartbeatTTL  time.Duration
 }
 
 // NewSvc is svc constructor.
-func NewSvc(store Store, ip IPSvc, sshPublicKey, sshPrivateKey string) *Svc {
-	return &Svc{store: store, ip: ip, sshPublicKey: sshPublicKey, sshPrivateKey: sshPrivateKey}
+func NewSvc(id string, store Store, ip IPSvc, device Device, sshPublicKey, sshPrivateKey string) *Svc {
+	return &Svc{id: id, store: store, ip: ip, device: device, sshPublicKey: sshPublicKey, sshPrivateKey: sshPrivateKey}
+}
+
+// SetHeartbeatTTL makes wgservers without a heartbeat in last ttl dead, dead servers are not peers of clients.
+// With zero ttl, default, every registered server is alive.
+func (s *Svc) SetHeartbeatTTL(ttl time.Duration) {
+	s.heartbeatTTL = ttl
 }
 
 // CreateInput struct
+// PrivateIP is allocated when omitted, ListenPort defaults to 51820.
 type CreateInput struct {
+	ID         string   `json:"id,omitempty"`
+	PublicKey  string   `json:"public_key,omitempty"`
+	Endpoint   string   `json:"endpoint,omitempty"`
+	ListenPort int      `json:"listen_port,omitempty"`
+	PrivateIP  string   `json:"private_ip,omitempty"`
+	CIDRs      []string `json:"cidrs,omitempty"`
 }
 
 // CreateOutput needs to be returned to wgserver
 type CreateOutput struct {
+	Server *WGServer `json:"server,omitempty"`
 }
 
-// Create wgserver.
+// Create registers wgserver, registering same id again updates it.
 func (s *Svc) Create(ctx context.Context, in *CreateInput) (*CreateOutput, error) {
-	return &CreateOutput{}, nil
+	if err := validateID(in.ID); err != nil {
+		return nil, err
+	}
+	if err := wgkey.Validate(in.PublicKey); err != nil {
+		return nil, &ValidationError{Field: "publickey", Reason: err.Error()}
+	}
+	if in.Endpoint == "" {
+		return nil, &ValidationError{Field: "endpoint", Reason: "required"}
+	}
+	if in.ListenPort < 0 || in.ListenPort > 65535 {
+		return nil, &ValidationError{Field: "listen_port", Reason: fmt.Sprintf("invalid:%d", in.ListenPort)}
+	}
+	privateIP := in.PrivateIP
+	if privateIP != "" {
+		ip := net.ParseIP(privateIP)
+		if ip == nil {
+			return nil, &ValidationError{Field: "private_ip", Reason: "invalid:" + in.PrivateIP}
+		}
+		privateIP = ip.String()
+	}
+	for _, c := range in.CIDRs {
+		if _, _, err := net.ParseCIDR(c); err != nil {
+			return nil, &ValidationError{Field: "cidrs", Reason: err.Error()}
+		}
+	}
+
+	srv := &WGServer{
+		ID:         in.ID,
+		PrivateIP:  privateIP,
+		Endpoint:   in.Endpoint,
+		ListenPort: in.ListenPort,
+		PublicKey:  in.PublicKey,
+		CIDRs:      in.CIDRs,
+	}
+	if srv.ListenPort == 0 {
+		srv.ListenPort = defaultListenPort
+	}
+
+	old, err := s.Server(ctx, in.ID)
+	if err != nil {
+		return nil, err
+	}
+	if srv.PrivateIP == "" && old != nil {
+		srv.PrivateIP = old.PrivateIP
+	}
+
+	switch {
+	case srv.PrivateIP == "":
+		srv.PrivateIP, err = s.ip.Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("ip:get:%w", err)
+		}
+	case old == nil || old.PrivateIP != srv.PrivateIP:
+		err = s.ip.Reserve(ctx, srv.PrivateIP)
+		if err != nil {
+			return nil, fmt.Errorf("ip:reserve:%w", err)
+		}
+	}
+
+	err = s.store.Set(ctx, s.key(srv.ID), srv)
+	if err != nil {
+		return nil, fmt.Errorf("store:set:wgserver:%v", err)
+	}
+
+	// server moved to another ip, its old one is free again.
+	if old != nil && old.PrivateIP != "" && old.PrivateIP != srv.PrivateIP {
+		err = s.ip.Release(ctx, old.PrivateIP)
+		if err != nil {
+			return nil, fmt.Errorf("ip:release:%v", err)
+		}
+	}
+
+	return &CreateOutput{Server: srv}, nil
 }
 
-// CronStorePeers scrape new peers (clients or servers) with wg tools and put on redis.
-func (s *Svc) CronStorePeers(ctx context.Context) error {
+// Server returns registered wgserver of id, nil if there is none.
+func (s *Svc) Server(ctx context.Context, id string) (*WGServer, error) {
+	v, err := s.store.Get(ctx, s.key(id))
+	if err != nil {
+		return nil, fmt.Errorf("store:get:wgserver:%v", err)
+	}
+
+	srv, _ := v.(*WGServer)
+	return srv, nil
+}
+
+// Servers returns all registered wgservers ordered by id.
+func (s *Svc) Servers(ctx context.Context) ([]*WGServer, error) {
+	keys, err := s.store.Keys(ctx, s.key(""))
+	if err != nil {
+		return nil, fmt.Errorf("store:keys:wgserver:%v", err)
+	}
+
+	srvs := []*WGServer{}
+	for _, k := range keys {
+		// skip peers of servers, i.e. wgserver:<id>:peer:<pk>
+		if strings.Contains(strings.TrimPrefix(k, s.key("")), ":") {
+			continue
+		}
+
+		v, err := s.store.Get(ctx, k)
+		if err != nil {
+			return nil, fmt.Errorf("store:get:wgserver:%v", err)
+		}
+
+		if srv, ok := v.(*WGServer); ok {
+			srvs = append(srvs, srv)
+		}
+	}
+	return srvs, nil
+}
+
+// Heartbeat marks registered wgserver of id alive for heartbeat ttl.
+func (s *Svc) Heartbeat(ctx context.Context, id string) (*ServerStatus, error) {
+	srv, err := s.Server(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if srv == nil {
+		return nil, ErrNotFound
+	}
+
+	now := time.Now().UTC()
+	err = s.store.Set(ctx, s.heartbeatKey(id), now)
+	if err != nil {
+		return nil, fmt.Errorf("store:set:heartbeat:%v", err)
+	}
+
+	if s.heartbeatTTL > 0 {
+		// ttl of store is in seconds, round up.
+		ttl := int((s.heartbeatTTL + time.Second - 1) / time.Second)
+		err = s.store.Set(ctx, s.aliveKey(id), now, ttl)
+		if err != nil {
+			return nil, fmt.Errorf("store:set:alive:%v", err)
+		}
+	}
+
+	return &ServerStatus{WGServer: srv, Alive: true, LastHeartbeat: now}, nil
+}
+
+// CronHeartbeat sends heartbeat of this wgserver, it is a no-op until the server is registered.
+func (s *Svc) CronHeartbeat(ctx context.Context) error {
+	_, err := s.Heartbeat(ctx, s.id)
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// ServerStatus returns liveness of all registered wgservers.
+func (s *Svc) ServerStatus(ctx context.Context) ([]*ServerStatus, error) {
+	srvs, err := s.Servers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	st := make([]*ServerStatus, 0, len(srvs))
+	for _, srv := range srvs {
+		alive, err := s.alive(ctx, srv.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := s.store.Get(ctx, s.heartbeatKey(srv.ID))
+		if err != nil {
+			return nil, fmt.Errorf("store:get:heartbeat:%v", err)
+		}
+		last, _ := v.(time.Time)
+
+		st = append(st, &ServerStatus{WGServer: srv, Alive: alive, LastHeartbeat: last})
+	}
+	return st, nil
+}
+
+// Import stores an existing server, e.g. interface of wg-quick config, and reserves its IP.
+// Importing same server again keeps its IP reserved, a new IP replaces its old one.
+func (s *Svc) Import(ctx context.Context, srv *WGServer) error {
+	if err := validateID(srv.ID); err != nil {
+		return err
+	}
+	if srv.PublicKey != "" {
+		if err := wgkey.Validate(srv.PublicKey); err != nil {
+			return &ValidationError{Field: "publickey", Reason: err.Error()}
+		}
+	}
+
+	old, err := s.Server(ctx, srv.ID)
+	if err != nil {
+		return err
+	}
+
+	if srv.PrivateIP != "" && (old == nil || old.PrivateIP != srv.PrivateIP) {
+		err := s.ip.Reserve(ctx, srv.PrivateIP)
+		if err != nil {
+			return fmt.Errorf("ip:reserve:%w", err)
+		}
+	}
+
+	err = s.store.Set(ctx, s.key(srv.ID), srv)
+	if err != nil {
+		return fmt.Errorf("store:set:wgserver:%v", err)
+	}
+
+	if old != nil && old.PrivateIP != "" && old.PrivateIP != srv.PrivateIP {
+		err = s.ip.Release(ctx, old.PrivateIP)
+		if err != nil {
+			return fmt.Errorf("ip:release:%v", err)
+		}
+	}
 	return nil
 }
 
-// CronSyncPeersFromStore syncs new peers (clients or servers) from store and add locally usin wg add tool.
-func (s *Svc) CronSyncPeersFromStore(ctx context.Context) error {
+// CronStorePeers scrape new peers (clients or servers) from wireguard device and put on store.
+// Peers which are no more on device are removed from store.
+func (s *Svc) CronStorePeers(ctx context.Context) error {
+	d, err := s.device.Device(ctx)
+	if err != nil {
+		return fmt.Errorf("device:get:%v", err)
+	}
+
+	stale, err := s.storedPeers(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, p := range d.Peers {
+		st := &WGPeerStatus{
+			WGPeer: wgpeer.WGPeer{
+				PublicKey:  p.PublicKey,
+				AllowedIPS: p.AllowedIPs,
+				EndPoint:   p.Endpoint,
+				KeepAlive:  p.PersistentKeepalive,
+			},
+			ServerID:      s.id,
+			LastHandshake: p.LastHandshake,
+			ReceiveBytes:  p.ReceiveBytes,
+			TransmitBytes: p.TransmitBytes,
+			ScrapedAt:     now,
+		}
+
+		err = s.store.Set(ctx, s.peerKey(p.PublicKey), st)
+		if err != nil {
+			return fmt.Errorf("store:set:peer:%v", err)
+		}
+		delete(stale, s.peerKey(p.PublicKey))
+	}
+
+	for k := range stale {
+		_, err = s.store.Delete(ctx, k)
+		if err != nil {
+			return fmt.Errorf("store:delete:peer:%v", err)
+		}
+	}
+
 	return nil
 }
 
-// ServerPeers returns list of server peers
+// CronSyncPeersFromStore reconciles peers of device against wgclients in store.
+// Missing peers are added, peers with changed allowed ips are updated and peers
+// not in store are removed. Running it again without store changes is a no-op.
+func (s *Svc) CronSyncPeersFromStore(ctx context.Context) (*SyncSummary, error) {
+	desired, err := s.desiredPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := s.device.Device(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("device:get:%v", err)
+	}
+
+	sum := &SyncSummary{}
+	apply := func(pc wgdevice.PeerConfig, counter *int) {
+		err := s.device.ConfigurePeers(ctx, []wgdevice.PeerConfig{pc})
+		if err != nil {
+			sum.Failed++
+			sum.Errors = append(sum.Errors, fmt.Sprintf("%s:%v", pc.PublicKey, err))
+			return
+		}
+		*counter++
+	}
+
+	actual := make(map[string]wgdevice.Peer, len(d.Peers))
+	for _, p := range d.Peers {
+		actual[p.PublicKey] = p
+	}
+
+	for _, pk := range sortedKeys(desired) {
+		pc := desired[pk]
+		p, ok := actual[pk]
+		switch {
+		case !ok:
+			apply(pc, &sum.Added)
+		case !sameIPs(p.AllowedIPs, pc.AllowedIPs) || p.PersistentKeepalive != pc.PersistentKeepalive || p.PresharedKey != pc.PresharedKey:
+			apply(pc, &sum.Updated)
+		}
+	}
+
+	for _, p := range d.Peers {
+		if _, ok := desired[p.PublicKey]; !ok {
+			apply(wgdevice.PeerConfig{PublicKey: p.PublicKey, Remove: true}, &sum.Removed)
+		}
+	}
+
+	if sum.Failed > 0 {
+		return sum, fmt.Errorf("device:configure:%d peers failed", sum.Failed)
+	}
+	return sum, nil
+}
+
+// Peers returns peers last scraped from device of this wgserver.
+func (s *Svc) Peers(ctx context.Context) ([]*WGPeerStatus, error) {
+	keys, err := s.store.Keys(ctx, s.peerKey(""))
+	if err != nil {
+		return nil, fmt.Errorf("store:keys:peer:%v", err)
+	}
+
+	ps := []*WGPeerStatus{}
+	for _, k := range keys {
+		v, err := s.store.Get(ctx, k)
+		if err != nil {
+			return nil, fmt.Errorf("store:get:peer:%v", err)
+		}
+
+		p, ok := v.(*WGPeerStatus)
+		if !ok {
+			continue
+		}
+		ps = append(ps, p)
+	}
+
+	return ps, nil
+}
+
+// ServerPeers returns alive registered wgservers having a public key and endpoint as peers of clients.
 func (s *Svc) ServerPeers(ctx context.Context) []wgpeer.WGPeer {
-	return []wgpeer.WGPeer{{PublicKey: s.sshPublicKey, EndPoint: "1.1.1.1"}}
+	srvs, err := s.Servers(ctx)
+	if err != nil {
+		return []wgpeer.WGPeer{}
+	}
+
+	ps := make([]wgpeer.WGPeer, 0, len(srvs))
+	for _, srv := range srvs {
+		if srv.PublicKey == "" || srv.Endpoint == "" {
+			continue
+		}
+		if alive, err := s.alive(ctx, srv.ID); err != nil || !alive {
+			continue
+		}
+		ps = append(ps, srv.Peer())
+	}
+	return ps
 }
 
 // SSHAuthorizedKeys returns list of valid sshpublickeys
@@ -72,6 +528,108 @@ func (s *Svc) SSHAuthorizedKeys(ctx context.Context) []string {
 	return []string{s.sshPublicKey}
 }
 
+// desiredPeers are all wgclients in store keyed by public key.
+func (s *Svc) desiredPeers(ctx context.Context) (map[string]wgdevice.PeerConfig, error) {
+	keys, err := s.store.Keys(ctx, "wgclient:")
+	if err != nil {
+		return nil, fmt.Errorf("store:keys:wgclient:%v", err)
+	}
+
+	now := time.Now()
+	m := make(map[string]wgdevice.PeerConfig, len(keys))
+	for _, k := range keys {
+		v, err := s.store.Get(ctx, k)
+		if err != nil {
+			return nil, fmt.Errorf("store:get:wgclient:%v", err)
+		}
+
+		// peers of expired clients are removed before they are deleted.
+		c, ok := v.(*wgclient.WGClient)
+		if !ok || c.PublicKey == "" || c.PrivateIP == "" || c.Expired(now) {
+			continue
+		}
+
+		m[c.PublicKey] = wgdevice.PeerConfig{
+			PublicKey:         c.PublicKey,
+			PresharedKey:      c.PresharedKey,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        c.AllowedIPs(),
+		}
+	}
+	return m, nil
+}
+
+func (s *Svc) storedPeers(ctx context.Context) (map[string]struct{}, error) {
+	keys, err := s.store.Keys(ctx, s.peerKey(""))
+	if err != nil {
+		return nil, fmt.Errorf("store:keys:peer:%v", err)
+	}
+
+	m := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		m[k] = struct{}{}
+	}
+	return m, nil
+}
+
+func (s *Svc) alive(ctx context.Context, id string) (bool, error) {
+	if s.heartbeatTTL <= 0 {
+		return true, nil
+	}
+
+	v, err := s.store.Get(ctx, s.aliveKey(id))
+	if err != nil {
+		return false, fmt.Errorf("store:get:alive:%v", err)
+	}
+	return v != nil, nil
+}
+
+func validateID(id string) error {
+	if id == "" || strings.Contains(id, ":") {
+		return ErrInvalidID
+	}
+	return nil
+}
+
 func (s *Svc) key(id string) string {
 	return fmt.Sprintf("wgserver:%s", id)
 }
+
+func (s *Svc) peerKey(pkey string) string {
+	return fmt.Sprintf("%s:peer:%s", s.key(s.id), pkey)
+}
+
+func (s *Svc) heartbeatKey(id string) string {
+	return fmt.Sprintf("%s:heartbeat", s.key(id))
+}
+
+func (s *Svc) aliveKey(id string) string {
+	return fmt.Sprintf("%s:alive", s.key(id))
+}
+
+func sameIPs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	x := append([]string{}, a...)
+	y := append([]string{}, b...)
+	sort.Strings(x)
+	sort.Strings(y)
+
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string]wgdevice.PeerConfig) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
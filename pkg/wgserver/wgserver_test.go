@@ -0,0 +1,505 @@
+package wgserver_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"bitbucket.org/qubole/wireguard/pkg/cache"
+	"bitbucket.org/qubole/wireguard/pkg/ip"
+	"bitbucket.org/qubole/wireguard/pkg/wgclient"
+	"bitbucket.org/qubole/wireguard/pkg/wgdevice"
+	"bitbucket.org/qubole/wireguard/pkg/wgpeer"
+	"bitbucket.org/qubole/wireguard/pkg/wgserver"
+	"inet.af/netaddr"
+)
+
+func TestSvc_Create(t *testing.T) {
+	ctx := context.Background()
+	pk := "8AnbIFIos5HjXibVWBjRxJhdqw/evd1pXsNCRvBmCnI="
+
+	tests := []struct {
+		name    string
+		in      *wgserver.CreateInput
+		want    *wgserver.WGServer
+		wantErr bool
+	}{
+		{
+			name: "TestCreateAllocatesIP",
+			in:   &wgserver.CreateInput{ID: "wg-1", PublicKey: pk, Endpoint: "34.93.47.5"},
+			want: &wgserver.WGServer{ID: "wg-1", PublicKey: pk, Endpoint: "34.93.47.5", ListenPort: 51820, PrivateIP: "10.33.0.2"},
+		},
+		{
+			name: "TestCreateReservesIP",
+			in:   &wgserver.CreateInput{ID: "wg-1", PublicKey: pk, Endpoint: "vpn.example.com", ListenPort: 443, PrivateIP: "10.33.0.100", CIDRs: []string{"10.33.0.0/24"}},
+			want: &wgserver.WGServer{ID: "wg-1", PublicKey: pk, Endpoint: "vpn.example.com", ListenPort: 443, PrivateIP: "10.33.0.100", CIDRs: []string{"10.33.0.0/24"}},
+		},
+		{name: "TestCreateIPInUse", in: &wgserver.CreateInput{ID: "wg-1", PublicKey: pk, Endpoint: "34.93.47.5", PrivateIP: "10.33.0.1"}, wantErr: true},
+		{name: "TestCreateInvalidID", in: &wgserver.CreateInput{ID: "wg:1", PublicKey: pk, Endpoint: "34.93.47.5"}, wantErr: true},
+		{name: "TestCreateInvalidKey", in: &wgserver.CreateInput{ID: "wg-1", PublicKey: "dhfjdbfjdbffg", Endpoint: "34.93.47.5"}, wantErr: true},
+		{name: "TestCreateNoEndpoint", in: &wgserver.CreateInput{ID: "wg-1", PublicKey: pk}, wantErr: true},
+		{name: "TestCreateInvalidCIDR", in: &wgserver.CreateInput{ID: "wg-1", PublicKey: pk, Endpoint: "34.93.47.5", CIDRs: []string{"10.33.0.0"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cache.NewMap()
+			pool, _ := netaddr.ParseIPPrefix("10.33.0.0/24")
+			ips, err := ip.NewSvc(c, pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// first ip of pool is taken.
+			if _, err := ips.Get(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			s := wgserver.NewSvc("wg-1", c, ips, wgdevice.NewFake("wg0", 51820), "test", "test")
+			got, err := s.Create(ctx, tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Svc.Create() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.Server, tt.want) {
+				t.Errorf("Svc.Create() = %+v, want %+v", got.Server, tt.want)
+			}
+
+			// registering again keeps ip.
+			again, err := s.Create(ctx, &wgserver.CreateInput{ID: tt.in.ID, PublicKey: pk, Endpoint: "34.93.47.6"})
+			if err != nil || again.Server.PrivateIP != tt.want.PrivateIP {
+				t.Errorf("Svc.Create() again = %+v, %v", again, err)
+			}
+		})
+	}
+}
+
+func TestSvc_CreateMovesIP(t *testing.T) {
+	ctx := context.Background()
+	pk := "8AnbIFIos5HjXibVWBjRxJhdqw/evd1pXsNCRvBmCnI="
+
+	c := cache.NewMap()
+	pool, _ := netaddr.ParseIPPrefix("10.33.0.0/24")
+	ips, err := ip.NewSvc(c, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips.SetQuarantine(0)
+
+	s := wgserver.NewSvc("wg-1", c, ips, wgdevice.NewFake("wg0", 51820), "test", "test")
+	first, err := s.Create(ctx, &wgserver.CreateInput{ID: "wg-1", PublicKey: pk, Endpoint: "34.93.47.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// server re-registers with an ip of its own.
+	got, err := s.Create(ctx, &wgserver.CreateInput{ID: "wg-1", PublicKey: pk, Endpoint: "34.93.47.5", PrivateIP: "10.33.0.200"})
+	if err != nil {
+		t.Fatalf("Svc.Create() error = %v", err)
+	}
+	if got.Server.PrivateIP != "10.33.0.200" {
+		t.Errorf("Svc.Create() private_ip = %s, want 10.33.0.200", got.Server.PrivateIP)
+	}
+
+	for _, k := range []string{"ip:allocated:" + first.Server.PrivateIP, "ip:reserved:" + first.Server.PrivateIP} {
+		if v, _ := c.Get(ctx, k); v != nil {
+			t.Errorf("Svc.Create() kept %s of old ip", k)
+		}
+	}
+	if v, _ := c.Get(ctx, "ip:reserved:10.33.0.200"); v == nil {
+		t.Errorf("Svc.Create() did not reserve new ip")
+	}
+
+	// old ip is handed out again.
+	if next, err := ips.Get(ctx); err != nil || next != first.Server.PrivateIP {
+		t.Errorf("ip.Svc.Get() = %s, %v, want %s", next, err, first.Server.PrivateIP)
+	}
+}
+
+func TestSvc_Import(t *testing.T) {
+	ctx := context.Background()
+	pk := "8AnbIFIos5HjXibVWBjRxJhdqw/evd1pXsNCRvBmCnI="
+
+	c := cache.NewMap()
+	pool, _ := netaddr.ParseIPPrefix("10.33.0.0/24")
+	ips, err := ip.NewSvc(c, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := wgserver.NewSvc("wg-1", c, ips, wgdevice.NewFake("wg0", 51820), "test", "test")
+
+	tests := []struct {
+		name    string
+		in      *wgserver.WGServer
+		wantErr bool
+	}{
+		{name: "TestImport", in: &wgserver.WGServer{ID: "wg-1", PublicKey: pk, PrivateIP: "10.33.0.1", ListenPort: 51820}},
+		{name: "TestImportAgain", in: &wgserver.WGServer{ID: "wg-1", PublicKey: pk, PrivateIP: "10.33.0.1", ListenPort: 51820}},
+		{name: "TestImportNoPublicKey", in: &wgserver.WGServer{ID: "wg-2", PrivateIP: "10.33.0.3"}},
+		{name: "TestImportInvalidID", in: &wgserver.WGServer{ID: "wg:3", PrivateIP: "10.33.0.4"}, wantErr: true},
+		{name: "TestImportInvalidKey", in: &wgserver.WGServer{ID: "wg-3", PublicKey: "dhfjdbfjdbffg", PrivateIP: "10.33.0.4"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.Import(ctx, tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Svc.Import() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got, err := s.Server(ctx, tt.in.ID)
+			if err != nil || !reflect.DeepEqual(got, tt.in) {
+				t.Errorf("Svc.Server() = %+v, %v, want %+v", got, err, tt.in)
+			}
+			if v, _ := c.Get(ctx, "ip:reserved:"+tt.in.PrivateIP); v == nil {
+				t.Errorf("Svc.Import() did not reserve %s", tt.in.PrivateIP)
+			}
+		})
+	}
+
+	if v, _ := c.Get(ctx, "ip:reserved:10.33.0.4"); v != nil {
+		t.Errorf("Svc.Import() reserved ip of invalid server")
+	}
+}
+
+func TestSvc_ServerPeers(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewMap()
+	s := wgserver.NewSvc("wg-1", c, nil, wgdevice.NewFake("wg0", 51820), "test", "test")
+
+	// imported servers without endpoint and peers of servers are not server peers.
+	c.Set(ctx, "wgserver:wg-0", &wgserver.WGServer{ID: "wg-0", PrivateIP: "10.0.0.1"})
+	c.Set(ctx, "wgserver:wg-1", &wgserver.WGServer{
+		ID: "wg-1", PrivateIP: "10.0.0.1", Endpoint: "34.93.47.5", ListenPort: 51820, PublicKey: "pk1",
+	})
+	c.Set(ctx, "wgserver:wg-1:peer:pk3", &wgserver.WGPeerStatus{})
+	c.Set(ctx, "wgserver:wg-2", &wgserver.WGServer{
+		ID: "wg-2", PrivateIP: "fd00::1", Endpoint: "vpn.example.com:443", ListenPort: 51820, PublicKey: "pk2", CIDRs: []string{"fd00::/64"},
+	})
+
+	want := []wgpeer.WGPeer{
+		{PublicKey: "pk1", EndPoint: "34.93.47.5:51820", AllowedIPS: []string{"10.0.0.1/32"}},
+		{PublicKey: "pk2", EndPoint: "vpn.example.com:443", AllowedIPS: []string{"fd00::/64"}},
+	}
+	if got := s.ServerPeers(ctx); !reflect.DeepEqual(got, want) {
+		t.Errorf("Svc.ServerPeers() = %+v, want %+v", got, want)
+	}
+}
+
+func TestSvc_CronStorePeers(t *testing.T) {
+	ctx := context.Background()
+	hs := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		before  []wgdevice.Peer
+		after   []wgdevice.Peer
+		devErr  error
+		want    map[string]int64 // public key -> rx bytes
+		wantErr bool
+	}{
+		{
+			name:   "TestCronStorePeersEmptyDevice",
+			before: nil,
+			want:   map[string]int64{},
+		},
+		{
+			name: "TestCronStorePeersSuccess",
+			before: []wgdevice.Peer{
+				{PublicKey: "pk1", AllowedIPs: []string{"10.0.0.2/32"}, Endpoint: "1.2.3.4:51820", LastHandshake: hs, ReceiveBytes: 10, TransmitBytes: 20},
+				{PublicKey: "pk2", AllowedIPs: []string{"10.0.0.3/32"}, ReceiveBytes: 30},
+			},
+			want: map[string]int64{"pk1": 10, "pk2": 30},
+		},
+		{
+			name: "TestCronStorePeersRemovesStale",
+			before: []wgdevice.Peer{
+				{PublicKey: "pk1", AllowedIPs: []string{"10.0.0.2/32"}, ReceiveBytes: 10},
+				{PublicKey: "pk2", AllowedIPs: []string{"10.0.0.3/32"}, ReceiveBytes: 30},
+			},
+			after: []wgdevice.Peer{
+				{PublicKey: "pk1", AllowedIPs: []string{"10.0.0.2/32"}, ReceiveBytes: 15},
+			},
+			want: map[string]int64{"pk1": 15},
+		},
+		{
+			name:    "TestCronStorePeersDeviceError",
+			devErr:  errors.New("boom"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := wgdevice.NewFake("wg0", 51820)
+			d.SetErr(tt.devErr)
+			for _, p := range tt.before {
+				d.AddPeer(p)
+			}
+
+			s := wgserver.NewSvc("server1", cache.NewMap(), nil, d, "test", "test")
+			err := s.CronStorePeers(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Svc.CronStorePeers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if tt.after != nil {
+				for _, p := range tt.before {
+					d.RemovePeer(p.PublicKey)
+				}
+				for _, p := range tt.after {
+					d.AddPeer(p)
+				}
+				if err := s.CronStorePeers(ctx); err != nil {
+					t.Fatalf("Svc.CronStorePeers() error = %v", err)
+				}
+			}
+
+			got, err := s.Peers(ctx)
+			if err != nil {
+				t.Fatalf("Svc.Peers() error = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Svc.Peers() = %d peers, want %d", len(got), len(tt.want))
+			}
+			for _, p := range got {
+				rx, ok := tt.want[p.PublicKey]
+				if !ok || p.ReceiveBytes != rx {
+					t.Errorf("Svc.Peers() peer %s rx = %d, want %d", p.PublicKey, p.ReceiveBytes, rx)
+				}
+				if p.ServerID != "server1" || p.ScrapedAt.IsZero() {
+					t.Errorf("Svc.Peers() peer %s = %+v, missing server id or scrape time", p.PublicKey, p)
+				}
+				if p.PublicKey == "pk1" && tt.after == nil && (!p.LastHandshake.Equal(hs) || p.EndPoint != "1.2.3.4:51820") {
+					t.Errorf("Svc.Peers() peer %s = %+v, want handshake %v", p.PublicKey, p, hs)
+				}
+			}
+		})
+	}
+}
+
+func TestSvc_CronSyncPeersFromStore(t *testing.T) {
+	ctx := context.Background()
+	expired := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name    string
+		clients []*wgclient.WGClient
+		device  []wgdevice.Peer
+		devErr  error
+		want    wgserver.SyncSummary
+		wantErr bool
+	}{
+		{
+			name:    "TestSyncPeersNothingToDo",
+			clients: nil,
+			device:  nil,
+			want:    wgserver.SyncSummary{},
+		},
+		{
+			name: "TestSyncPeersAddUpdateRemove",
+			clients: []*wgclient.WGClient{
+				{ID: "1", PublicKey: "pk1", PrivateIP: "10.0.0.2"},
+				{ID: "2", PublicKey: "pk2", PrivateIP: "10.0.0.3"},
+				{ID: "3", PublicKey: "pk3", PrivateIP: "10.0.0.4"},
+			},
+			device: []wgdevice.Peer{
+				{PublicKey: "pk2", AllowedIPs: []string{"10.0.0.3/32"}},
+				{PublicKey: "pk3", AllowedIPs: []string{"10.0.0.9/32"}},
+				{PublicKey: "pk4", AllowedIPs: []string{"10.0.0.5/32"}},
+			},
+			want: wgserver.SyncSummary{Added: 1, Updated: 1, Removed: 1},
+		},
+		{
+			name: "TestSyncPeersDualStack",
+			clients: []*wgclient.WGClient{
+				{ID: "1", PublicKey: "pk1", PrivateIP: "10.0.0.2", PrivateIPv6: "fd00::2"},
+			},
+			device: []wgdevice.Peer{
+				{PublicKey: "pk1", AllowedIPs: []string{"10.0.0.2/32"}},
+			},
+			want: wgserver.SyncSummary{Updated: 1},
+		},
+		{
+			name: "TestSyncPeersRemovesExpired",
+			clients: []*wgclient.WGClient{
+				{ID: "1", PublicKey: "pk1", PrivateIP: "10.0.0.2"},
+				{ID: "2", PublicKey: "pk2", PrivateIP: "10.0.0.3", ExpiresAt: &expired},
+			},
+			device: []wgdevice.Peer{
+				{PublicKey: "pk1", AllowedIPs: []string{"10.0.0.2/32"}},
+				{PublicKey: "pk2", AllowedIPs: []string{"10.0.0.3/32"}},
+			},
+			want: wgserver.SyncSummary{Removed: 1},
+		},
+		{
+			name:    "TestSyncPeersDeviceError",
+			clients: []*wgclient.WGClient{{ID: "1", PublicKey: "pk1", PrivateIP: "10.0.0.2"}},
+			devErr:  errors.New("boom"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cache.NewMap()
+			for _, cl := range tt.clients {
+				c.Set(ctx, "wgclient:"+cl.ID, cl)
+				c.Set(ctx, "pubkey:wgclient:"+cl.PublicKey, cl)
+			}
+
+			d := wgdevice.NewFake("wg0", 51820)
+			for _, p := range tt.device {
+				d.AddPeer(p)
+			}
+			d.SetErr(tt.devErr)
+
+			s := wgserver.NewSvc("server1", c, nil, d, "test", "test")
+			got, err := s.CronSyncPeersFromStore(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Svc.CronSyncPeersFromStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Svc.CronSyncPeersFromStore() = %+v, want %+v", *got, tt.want)
+			}
+
+			live := 0
+			for _, cl := range tt.clients {
+				if !cl.Expired(time.Now()) {
+					live++
+				}
+			}
+			dev, _ := d.Device(ctx)
+			if len(dev.Peers) != live {
+				t.Fatalf("device has %d peers, want %d", len(dev.Peers), live)
+			}
+			for _, p := range dev.Peers {
+				v, _ := c.Get(ctx, "pubkey:wgclient:"+p.PublicKey)
+				cl, ok := v.(*wgclient.WGClient)
+				if !ok || !reflect.DeepEqual(p.AllowedIPs, cl.AllowedIPs()) {
+					t.Errorf("device peer %s allowed ips = %v", p.PublicKey, p.AllowedIPs)
+				}
+			}
+
+			// second run must be a no-op.
+			got, err = s.CronSyncPeersFromStore(ctx)
+			if err != nil || !reflect.DeepEqual(*got, wgserver.SyncSummary{}) {
+				t.Errorf("Svc.CronSyncPeersFromStore() rerun = %+v, %v, want no-op", got, err)
+			}
+		})
+	}
+}
+
+func TestSvc_CronSyncPeersFromStorePartialFailure(t *testing.T) {
+	ctx := context.Background()
+
+	c := cache.NewMap()
+	c.Set(ctx, "wgclient:1", &wgclient.WGClient{ID: "1", PublicKey: "pk1", PrivateIP: "10.0.0.2"})
+	c.Set(ctx, "wgclient:2", &wgclient.WGClient{ID: "2", PublicKey: "pk2", PrivateIP: "10.0.0.3"})
+
+	d := &failingDevice{Fake: wgdevice.NewFake("wg0", 51820), fail: "pk1"}
+	s := wgserver.NewSvc("server1", c, nil, d, "test", "test")
+
+	got, err := s.CronSyncPeersFromStore(ctx)
+	if err == nil {
+		t.Fatalf("Svc.CronSyncPeersFromStore() error = nil, want error")
+	}
+	if got.Added != 1 || got.Failed != 1 || len(got.Errors) != 1 {
+		t.Errorf("Svc.CronSyncPeersFromStore() = %+v, want 1 added and 1 failed", got)
+	}
+}
+
+// failingDevice fails configuring one peer.
+type failingDevice struct {
+	*wgdevice.Fake
+	fail string
+}
+
+func (f *failingDevice) ConfigurePeers(ctx context.Context, peers []wgdevice.PeerConfig) error {
+	for _, p := range peers {
+		if p.PublicKey == f.fail {
+			return errors.New("configure failed")
+		}
+	}
+	return f.Fake.ConfigurePeers(ctx, peers)
+}
+
+func TestSvc_Heartbeat(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		ttl        time.Duration
+		heartbeat  []string
+		wantErr    bool
+		wantAlive  map[string]bool
+		wantPeerPK []string
+	}{
+		{
+			name:       "TestHeartbeatDisabled",
+			wantAlive:  map[string]bool{"wg-1": true, "wg-2": true},
+			wantPeerPK: []string{"pk1", "pk2"},
+		},
+		{
+			name:       "TestHeartbeatStaleExcluded",
+			ttl:        time.Minute,
+			heartbeat:  []string{"wg-2"},
+			wantAlive:  map[string]bool{"wg-1": false, "wg-2": true},
+			wantPeerPK: []string{"pk2"},
+		},
+		{
+			name:      "TestHeartbeatUnregistered",
+			ttl:       time.Minute,
+			heartbeat: []string{"wg-3"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cache.NewMap()
+			c.Set(ctx, "wgserver:wg-1", &wgserver.WGServer{ID: "wg-1", Endpoint: "34.93.47.5:51820", PublicKey: "pk1"})
+			c.Set(ctx, "wgserver:wg-2", &wgserver.WGServer{ID: "wg-2", Endpoint: "34.93.47.6:51820", PublicKey: "pk2"})
+
+			s := wgserver.NewSvc("wg-1", c, nil, wgdevice.NewFake("wg0", 51820), "test", "test")
+			s.SetHeartbeatTTL(tt.ttl)
+
+			for _, id := range tt.heartbeat {
+				_, err := s.Heartbeat(ctx, id)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("Svc.Heartbeat() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			}
+			if tt.wantErr {
+				return
+			}
+
+			st, err := s.ServerStatus(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alive := map[string]bool{}
+			for _, srv := range st {
+				alive[srv.ID] = srv.Alive
+			}
+			if !reflect.DeepEqual(alive, tt.wantAlive) {
+				t.Errorf("Svc.ServerStatus() alive = %v, want %v", alive, tt.wantAlive)
+			}
+
+			pks := []string{}
+			for _, p := range s.ServerPeers(ctx) {
+				pks = append(pks, p.PublicKey)
+			}
+			if !reflect.DeepEqual(pks, tt.wantPeerPK) {
+				t.Errorf("Svc.ServerPeers() = %v, want %v", pks, tt.wantPeerPK)
+			}
+		})
+	}
+}